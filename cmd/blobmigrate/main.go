@@ -0,0 +1,113 @@
+// Command blobmigrate copies media content from one blob store backend to
+// another, e.g. to move blobs out of the SQLite file into a directory or
+// an S3 bucket. Run it while the web API is stopped, then restart the web
+// API configured with the destination backend.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ardanlabs/conf"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tassdam/wasa/service/blobstore"
+	"github.com/tassdam/wasa/service/database"
+)
+
+type migrationConfiguration struct {
+	DB struct {
+		Filename string `conf:"default:/tmp/decaf.db"`
+	}
+	From         blobstore.Config
+	To           blobstore.Config
+	DeleteSource bool `conf:"default:false"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var cfg migrationConfiguration
+	if err := conf.Parse(os.Args[1:], "CFG", &cfg); err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			usage, err := conf.Usage("CFG", &cfg)
+			if err != nil {
+				return fmt.Errorf("generating config usage: %w", err)
+			}
+			fmt.Println(usage)
+			return nil
+		}
+		return fmt.Errorf("parsing config: %w", err)
+	}
+	if cfg.From == cfg.To {
+		return errors.New("source and destination blob stores are the same")
+	}
+	dbconn, err := sql.Open("sqlite3", database.DSN(cfg.DB.Filename))
+	if err != nil {
+		return fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer dbconn.Close()
+	src, err := blobstore.New(cfg.From, dbconn)
+	if err != nil {
+		return fmt.Errorf("creating source blob store: %w", err)
+	}
+	dst, err := blobstore.New(cfg.To, dbconn)
+	if err != nil {
+		return fmt.Errorf("creating destination blob store: %w", err)
+	}
+	if _, _, err := database.Migrate(dbconn, src); err != nil {
+		return fmt.Errorf("migrating database: %w", err)
+	}
+	db, err := database.New(dbconn, src, 0)
+	if err != nil {
+		return fmt.Errorf("creating AppDatabase: %w", err)
+	}
+	ctx := context.Background()
+	hashes, err := db.ListMediaHashes(ctx)
+	if err != nil {
+		return err
+	}
+	copied, skipped, err := migrateBlobs(ctx, hashes, src, dst, cfg.DeleteSource)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %d blobs from %s to %s (%d already present)\n", copied, cfg.From.Backend, cfg.To.Backend, skipped)
+	return nil
+}
+
+// migrateBlobs copies the blobs with the given hashes from src to dst,
+// optionally deleting them from src. Blobs already moved by an earlier run
+// are counted as skipped.
+func migrateBlobs(ctx context.Context, hashes []string, src, dst blobstore.BlobStore, deleteSource bool) (copied, skipped int, err error) {
+	for _, hash := range hashes {
+		data, err := src.Get(ctx, hash)
+		if errors.Is(err, blobstore.ErrBlobNotFound) {
+			// Already moved by an earlier run with --delete-source.
+			if _, err := dst.Get(ctx, hash); err != nil {
+				return copied, skipped, fmt.Errorf("blob %s is missing from both stores: %w", hash, err)
+			}
+			skipped++
+			continue
+		}
+		if err != nil {
+			return copied, skipped, fmt.Errorf("reading blob %s: %w", hash, err)
+		}
+		if err := dst.Put(ctx, hash, data); err != nil {
+			return copied, skipped, fmt.Errorf("writing blob %s: %w", hash, err)
+		}
+		if deleteSource {
+			if err := src.Delete(ctx, hash); err != nil {
+				return copied, skipped, fmt.Errorf("deleting source blob %s: %w", hash, err)
+			}
+		}
+		copied++
+	}
+	return copied, skipped, nil
+}
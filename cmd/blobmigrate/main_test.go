@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/tassdam/wasa/service/blobstore"
+	"github.com/tassdam/wasa/service/database"
+)
+
+func TestMigrateSQLiteToFS(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbconn, err := sql.Open("sqlite3", database.DSN(filepath.Join(dir, "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbconn.Close()
+	src, err := blobstore.New(blobstore.Config{Backend: blobstore.BackendSQLite}, dbconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := blobstore.New(blobstore.Config{Backend: blobstore.BackendFS, Dir: filepath.Join(dir, "blobs")}, dbconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := database.Migrate(dbconn, src); err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.New(dbconn, src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var media []database.Media
+	for i := 0; i < 3; i++ {
+		m, err := db.CreateMedia(ctx, fmt.Sprintf("media%d", i), "image/png", []byte(fmt.Sprintf("content %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		media = append(media, m)
+	}
+
+	hashes, err := db.ListMediaHashes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, skipped, err := migrateBlobs(ctx, hashes, src, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != len(media) || skipped != 0 {
+		t.Errorf("first run copied %d and skipped %d, want %d and 0", copied, skipped, len(media))
+	}
+	copied, skipped, err = migrateBlobs(ctx, hashes, src, dst, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 0 || skipped != len(media) {
+		t.Errorf("second run copied %d and skipped %d, want 0 and %d", copied, skipped, len(media))
+	}
+
+	migrated, err := database.New(dbconn, dst, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range media {
+		if _, err := src.Get(ctx, m.Sha256); !errors.Is(err, blobstore.ErrBlobNotFound) {
+			t.Errorf("source still holds %s: %v", m.Id, err)
+		}
+		data, err := migrated.GetMediaData(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, m.Data) {
+			t.Errorf("%s reads back as %q, want %q", m.Id, data, m.Data)
+		}
+	}
+}
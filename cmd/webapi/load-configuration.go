@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ardanlabs/conf"
+	"github.com/tassdam/wasa/service/blobstore"
 	"gopkg.in/yaml.v2"
 )
 
@@ -21,11 +22,24 @@ type WebAPIConfiguration struct {
 		ReadTimeout     time.Duration `conf:"default:5s"`
 		WriteTimeout    time.Duration `conf:"default:5s"`
 		ShutdownTimeout time.Duration `conf:"default:5s"`
+		// EventStreamDuration is how long an event stream stays open before
+		// the client is asked to reconnect.
+		EventStreamDuration time.Duration `conf:"default:5m"`
 	}
 	Debug bool
-	DB    struct {
-		Filename string `conf:"default:/tmp/decaf.db"`
+	// MigrateOnly upgrades the database schema and exits.
+	MigrateOnly bool
+	DB          struct {
+		Filename     string        `conf:"default:/tmp/decaf.db"`
+		QueryTimeout time.Duration `conf:"default:5s"`
 	}
+	Session struct {
+		TTL time.Duration `conf:"default:720h"`
+	}
+	Messages struct {
+		EditWindow time.Duration `conf:"default:15m"`
+	}
+	Blobs blobstore.Config
 }
 
 func loadConfiguration() (WebAPIConfiguration, error) {
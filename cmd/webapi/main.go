@@ -15,6 +15,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 	"github.com/tassdam/wasa/service/api"
+	"github.com/tassdam/wasa/service/blobstore"
 	"github.com/tassdam/wasa/service/database"
 	"github.com/tassdam/wasa/service/globaltime"
 )
@@ -44,7 +45,7 @@ func run() error {
 	}
 	logger.Infof("application initializing")
 	logger.Println("initializing database support")
-	dbconn, err := sql.Open("sqlite3", cfg.DB.Filename)
+	dbconn, err := sql.Open("sqlite3", database.DSN(cfg.DB.Filename))
 	if err != nil {
 		logger.WithError(err).Error("error opening SQLite DB")
 		return fmt.Errorf("opening SQLite: %w", err)
@@ -53,18 +54,46 @@ func run() error {
 		logger.Debug("database stopping")
 		_ = dbconn.Close()
 	}()
-	db, err := database.New(dbconn)
+	blobs, err := blobstore.New(cfg.Blobs, dbconn)
+	if err != nil {
+		logger.WithError(err).Error("error creating blob store")
+		return fmt.Errorf("creating blob store: %w", err)
+	}
+	logger.Infof("storing blobs in the %s backend", cfg.Blobs.Backend)
+	from, to, err := database.Migrate(dbconn, blobs)
+	if err != nil {
+		logger.WithError(err).Error("error migrating the database schema")
+		return fmt.Errorf("migrating database: %w", err)
+	}
+	if from != to {
+		logger.Infof("database schema migrated from version %d to %d", from, to)
+	} else {
+		logger.Infof("database schema at version %d", to)
+	}
+	if cfg.MigrateOnly {
+		return nil
+	}
+	db, err := database.New(dbconn, blobs, cfg.DB.QueryTimeout)
 	if err != nil {
 		logger.WithError(err).Error("error creating AppDatabase")
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
+	if err := db.DeleteExpiredSessions(context.Background()); err != nil {
+		logger.WithError(err).Warning("error deleting expired sessions")
+	}
+	if !database.FullTextSearch {
+		logger.Warning("built without the sqlite_fts5 tag, message search falls back to substring matching")
+	}
 	logger.Info("initializing API server")
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 	serverErrors := make(chan error, 1)
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:              logger,
+		Database:            db,
+		SessionTTL:          cfg.Session.TTL,
+		EventStreamDuration: cfg.Web.EventStreamDuration,
+		MessageEditWindow:   cfg.Messages.EditWindow,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -83,6 +112,7 @@ func run() error {
 		ReadTimeout:       cfg.Web.ReadTimeout,
 		ReadHeaderTimeout: cfg.Web.ReadTimeout,
 		WriteTimeout:      cfg.Web.WriteTimeout,
+		ConnContext:       api.ConnContext,
 	}
 	go func() {
 		logger.Infof("API listening on %s", apiserver.Addr)
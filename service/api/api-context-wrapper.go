@@ -1,31 +1,81 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
 )
 
 type httpRouterHandler func(http.ResponseWriter, *http.Request, httprouter.Params, reqcontext.RequestContext)
 
 func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		reqUUID, err := uuid.NewV4()
+		ctx, err := rt.newRequestContext(r)
 		if err != nil {
 			rt.baseLogger.WithError(err).Error("can't generate a request UUID")
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		var ctx = reqcontext.RequestContext{
-			ReqUUID: reqUUID,
+		fn(w, r, ps, ctx)
+	}
+}
+
+func (rt *_router) wrapAuth(fn httpRouterHandler) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx, err := rt.newRequestContext(r)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("can't generate a request UUID")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		user, err := rt.authenticate(r)
+		if errors.Is(err, ErrUnauthorized) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			rt.internalError(w, ctx, err, "can't authenticate request")
+			return
 		}
-		ctx.Logger = rt.baseLogger.WithFields(logrus.Fields{
-			"reqid":     ctx.ReqUUID.String(),
-			"remote-ip": r.RemoteAddr,
-		})
+		ctx.UserID = user.Id
+		ctx.User = user
+		ctx.Logger = ctx.Logger.WithField("userid", user.Id)
+		rt.presence.Touch(user.Id)
 		fn(w, r, ps, ctx)
 	}
 }
+
+func (rt *_router) newRequestContext(r *http.Request) (reqcontext.RequestContext, error) {
+	reqUUID, err := uuid.NewV4()
+	if err != nil {
+		return reqcontext.RequestContext{}, err
+	}
+	var ctx = reqcontext.RequestContext{
+		ReqUUID: reqUUID,
+		Context: r.Context(),
+	}
+	ctx.Logger = rt.baseLogger.WithFields(logrus.Fields{
+		"reqid":     ctx.ReqUUID.String(),
+		"remote-ip": r.RemoteAddr,
+	})
+	return ctx, nil
+}
+
+func (rt *_router) authenticate(r *http.Request) (database.User, error) {
+	token, err := getBearerToken(r)
+	if err != nil {
+		return database.User{}, err
+	}
+	user, err := rt.db.GetSessionUser(r.Context(), token)
+	if errors.Is(err, database.ErrSessionDoesNotExist) || errors.Is(err, database.ErrSessionExpired) {
+		return database.User{}, ErrUnauthorized
+	} else if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
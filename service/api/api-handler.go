@@ -6,25 +6,49 @@ import (
 
 func (rt *_router) Handler() http.Handler {
 	rt.router.POST("/session", rt.wrap(rt.doLogin))
-	rt.router.GET("/users/photo", rt.wrap(rt.getMyPhoto))
-	rt.router.PUT("/users/photo", rt.wrap(rt.setMyPhoto))
-	rt.router.PUT("/users/name", rt.wrap(rt.setMyUserName))
-	rt.router.GET("/conversations", rt.wrap(rt.getMyConversations))
-	rt.router.POST("/conversations", rt.wrap(rt.startConversation))
-	rt.router.GET("/groups", rt.wrap(rt.getMyGroups))
-	rt.router.POST("/groups", rt.wrap(rt.createGroup))
-	rt.router.GET("/search", rt.wrap(rt.searchUsers))
-	rt.router.GET("/conversations/:conversationId", rt.wrap(rt.getConversation))
-	rt.router.POST("/conversations/:conversationId/message", rt.wrap(rt.sendMessage))
-	rt.router.DELETE("/conversations/:conversationId/message/:messageId", rt.wrap(rt.deleteMessage))
-	rt.router.POST("/conversations/:conversationId/message/:messageId/forward", rt.wrap(rt.forwardMessage))
-	rt.router.POST("/conversations/:conversationId/message/:messageId/comment", rt.wrap(rt.commentMessage))
-	rt.router.DELETE("/conversations/:conversationId/message/:messageId/comment", rt.wrap(rt.uncommentMessage))
-	rt.router.GET("/groups/:groupId", rt.wrap(rt.getGroup))
-	rt.router.DELETE("/groups/:groupId", rt.wrap(rt.leaveGroup))
-	rt.router.POST("/groups/:groupId", rt.wrap(rt.addToGroup))
-	rt.router.PUT("/groups/:groupId/name", rt.wrap(rt.setGroupName))
-	rt.router.PUT("/groups/:groupId/photo", rt.wrap(rt.setGroupPhoto))
+	rt.router.DELETE("/session", rt.wrapAuth(rt.doLogout))
+	rt.router.GET("/users/photo", rt.wrapAuth(rt.getMyPhoto))
+	rt.router.PUT("/users/photo", rt.wrapAuth(rt.setMyPhoto))
+	rt.router.PUT("/users/name", rt.wrapAuth(rt.setMyUserName))
+	rt.router.GET("/users/presence", rt.wrapAuth(rt.getPresence))
+	rt.router.PUT("/users/presence", rt.wrapAuth(rt.setPresenceVisibility))
+	rt.router.GET("/conversations", rt.wrapAuth(rt.getMyConversations))
+	rt.router.POST("/conversations", rt.wrapAuth(rt.startConversation))
+	rt.router.GET("/groups", rt.wrapAuth(rt.getMyGroups))
+	rt.router.POST("/groups", rt.wrapAuth(rt.createGroup))
+	rt.router.GET("/search", rt.wrapAuth(rt.searchUsers))
+	rt.router.GET("/search/messages", rt.wrapAuth(rt.searchMessages))
+	rt.router.GET("/starred", rt.wrapAuth(rt.getStarredMessages))
+	rt.router.GET("/unread", rt.wrapAuth(rt.getUnreadTotal))
+	rt.router.GET("/conversations/:conversationId", rt.wrapAuth(rt.getConversation))
+	rt.router.GET("/conversations/:conversationId/messages", rt.wrapAuth(rt.getConversationMessages))
+	rt.router.POST("/conversations/:conversationId/message", rt.wrapAuth(rt.sendMessage))
+	rt.router.POST("/conversations/:conversationId/read", rt.wrapAuth(rt.markConversationRead))
+	rt.router.POST("/conversations/:conversationId/typing", rt.wrapAuth(rt.startTyping))
+	rt.router.DELETE("/conversations/:conversationId/typing", rt.wrapAuth(rt.stopTyping))
+	rt.router.PUT("/conversations/:conversationId/message/:messageId", rt.wrapAuth(rt.editMessage))
+	rt.router.DELETE("/conversations/:conversationId/message/:messageId", rt.wrapAuth(rt.deleteMessage))
+	rt.router.GET("/conversations/:conversationId/message/:messageId/edits", rt.wrapAuth(rt.getMessageEdits))
+	rt.router.GET("/conversations/:conversationId/message/:messageId/receipts", rt.wrapAuth(rt.getMessageReceipts))
+	rt.router.POST("/conversations/:conversationId/message/:messageId/pin", rt.wrapAuth(rt.pinMessage))
+	rt.router.DELETE("/conversations/:conversationId/message/:messageId/pin", rt.wrapAuth(rt.unpinMessage))
+	rt.router.POST("/conversations/:conversationId/message/:messageId/star", rt.wrapAuth(rt.starMessage))
+	rt.router.DELETE("/conversations/:conversationId/message/:messageId/star", rt.wrapAuth(rt.unstarMessage))
+	rt.router.POST("/conversations/:conversationId/message/:messageId/forward", rt.wrapAuth(rt.forwardMessage))
+	rt.router.POST("/conversations/:conversationId/message/:messageId/comment", rt.wrapAuth(rt.commentMessage))
+	rt.router.DELETE("/conversations/:conversationId/message/:messageId/comment", rt.wrapAuth(rt.uncommentMessage))
+	rt.router.GET("/conversations/:conversationId/message/:messageId/reactions", rt.wrapAuth(rt.getReactions))
+	rt.router.POST("/conversations/:conversationId/message/:messageId/reactions", rt.wrapAuth(rt.toggleReaction))
+	rt.router.GET("/groups/:groupId", rt.wrapAuth(rt.getGroup))
+	rt.router.DELETE("/groups/:groupId", rt.wrapAuth(rt.leaveGroup))
+	rt.router.POST("/groups/:groupId", rt.wrapAuth(rt.addToGroup))
+	rt.router.PUT("/groups/:groupId/name", rt.wrapAuth(rt.setGroupName))
+	rt.router.PUT("/groups/:groupId/photo", rt.wrapAuth(rt.setGroupPhoto))
+	rt.router.PUT("/groups/:groupId/owner", rt.wrapAuth(rt.transferGroupOwnership))
+	rt.router.DELETE("/groups/:groupId/members/:userId", rt.wrapAuth(rt.removeFromGroup))
+	rt.router.PUT("/groups/:groupId/members/:userId/role", rt.wrapAuth(rt.setGroupMemberRole))
+	rt.router.GET("/media/:mediaId", rt.wrapAuth(rt.getMedia))
+	rt.router.GET("/events", rt.wrapAuth(rt.streamEvents))
 	rt.router.GET("/liveness", rt.liveness)
 	return rt.router
 }
@@ -2,16 +2,33 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+	"github.com/tassdam/wasa/service/presence"
+)
+
+const (
+	eventBacklogSize  = 1000
+	presenceOnlineTTL = time.Minute
+	typingTTL         = 6 * time.Second
+	maxPinnedMessages = 10
+	maxForwardTargets = 20
 )
 
 type Config struct {
-	Logger   logrus.FieldLogger
-	Database database.AppDatabase
+	Logger              logrus.FieldLogger
+	Database            database.AppDatabase
+	SessionTTL          time.Duration
+	EventStreamDuration time.Duration
+	// MessageEditWindow limits how long after sending a message can be
+	// edited; zero allows editing at any time.
+	MessageEditWindow time.Duration
 }
 
 type Router interface {
@@ -26,18 +43,37 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.SessionTTL <= 0 {
+		return nil, errors.New("session TTL must be positive")
+	}
+	if cfg.EventStreamDuration <= eventStreamHeartbeat {
+		return nil, fmt.Errorf("event stream duration must be longer than the %s heartbeat", eventStreamHeartbeat)
+	}
+	if cfg.MessageEditWindow < 0 {
+		return nil, errors.New("message edit window must not be negative")
+	}
 	router := httprouter.New()
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
+		router:              router,
+		baseLogger:          cfg.Logger,
+		db:                  cfg.Database,
+		sessionTTL:          cfg.SessionTTL,
+		events:              events.NewHub(eventBacklogSize),
+		eventStreamDuration: cfg.EventStreamDuration,
+		messageEditWindow:   cfg.MessageEditWindow,
+		presence:            presence.NewTracker(presenceOnlineTTL, typingTTL),
 	}, nil
 }
 
 type _router struct {
-	router     *httprouter.Router
-	baseLogger logrus.FieldLogger
-	db         database.AppDatabase
+	router              *httprouter.Router
+	baseLogger          logrus.FieldLogger
+	db                  database.AppDatabase
+	sessionTTL          time.Duration
+	events              *events.Hub
+	eventStreamDuration time.Duration
+	messageEditWindow   time.Duration
+	presence            *presence.Tracker
 }
@@ -3,13 +3,23 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"time"
+	"strconv"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/tassdam/wasa/service/api/reqcontext"
 	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 500
+
+	deleteForMe       = "me"
+	deleteForEveryone = "everyone"
 )
 
 func (rt *_router) startConversation(
@@ -19,38 +29,45 @@ func (rt *_router) startConversation(
 	ctx reqcontext.RequestContext,
 ) {
 	var req struct {
-		SenderID    string `json:"senderId"`
 		RecipientID string `json:"recipientId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if req.SenderID == "" || req.RecipientID == "" {
-		http.Error(w, "Missing senderId or recipientId", http.StatusBadRequest)
+	if req.RecipientID == "" {
+		http.Error(w, "Missing recipientId", http.StatusBadRequest)
+		return
+	}
+	if _, err := rt.db.GetUserById(ctx.Context, req.RecipientID); errors.Is(err, database.ErrUserDoesNotExist) {
+		http.Error(w, "Recipient not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch recipient")
 		return
 	}
-	conversationID, err := rt.db.GetDirectConversation(req.SenderID, req.RecipientID)
+	conversationID, err := rt.db.GetDirectConversation(ctx.Context, ctx.UserID, req.RecipientID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to check conversation existence")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to check conversation existence")
 		return
 	}
+	status := http.StatusOK
 	if conversationID == "" {
 		conversationID, err = generateNewID()
 		if err != nil {
-			ctx.Logger.WithError(err).Error("Failed to generate conversation ID")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to generate conversation ID")
 			return
 		}
-		err = rt.db.CreateDirectConversation(conversationID, req.SenderID, req.RecipientID)
+		err = rt.db.CreateDirectConversation(ctx.Context, conversationID, ctx.UserID, req.RecipientID)
 		if err != nil {
-			ctx.Logger.WithError(err).Error("Failed to create new conversation")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to create new conversation")
 			return
 		}
+		status = http.StatusCreated
+		rt.publishEvent(ctx, events.ConversationCreated, conversationID, nil)
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(map[string]string{
 		"conversationId": conversationID,
 	}); err != nil {
@@ -69,40 +86,118 @@ func (rt *_router) getConversation(
 		http.Error(w, "Missing conversationId", http.StatusBadRequest)
 		return
 	}
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	userID := ctx.UserID
+	if !rt.requireConversationMember(w, ctx, conversationID) {
 		return
 	}
-	isMember, err := rt.db.IsUserInConversation(conversationID, userID)
+	page, err := parseMessagePage(r)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to check conversation membership")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !isMember {
-		http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
-		return
-	}
-	if err := rt.db.MarkMessagesAsRead(conversationID, userID); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to mark messages as read")
-	}
-	conversation, err := rt.db.GetConversationDetails(conversationID, userID)
+	conversation, err := rt.db.GetConversationDetails(ctx.Context, conversationID, userID, page)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch conversation details")
 		if errors.Is(err, database.ErrConversationDoesNotExist) {
 			http.Error(w, "Conversation not found", http.StatusNotFound)
+		} else if errors.Is(err, database.ErrMessageDoesNotExist) {
+			http.Error(w, "Cursor message not found", http.StatusBadRequest)
 		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to fetch conversation details")
 		}
 		return
 	}
+	rt.markPageDelivered(ctx, conversationID, conversation.Messages)
+	view := ConversationView{Conversation: conversation, Typing: []string{}}
+	for _, id := range rt.presence.Typing(conversationID) {
+		if id != userID {
+			view.Typing = append(view.Typing, id)
+		}
+	}
+	view.Presence, err = rt.presenceStatuses(ctx, conversation.Members)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch member presence")
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(conversation); err != nil {
+	if err := json.NewEncoder(w).Encode(view); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to encode conversation details")
 	}
 }
 
+func (rt *_router) getConversationMessages(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	page, err := parseMessagePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, hasMore, err := rt.db.GetMessagesForConversation(ctx.Context, conversationID, ctx.UserID, page)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Cursor message not found", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch messages")
+		return
+	}
+	if messages == nil {
+		messages = []database.Message{}
+	}
+	rt.markPageDelivered(ctx, conversationID, messages)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(MessagesPage{
+		Messages: messages,
+		HasMore:  hasMore,
+	}); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode messages")
+	}
+}
+
+// markPageDelivered marks the messages of a page the caller has just
+// received as delivered to them. Older messages the page does not reach
+// stay pending until they are fetched.
+func (rt *_router) markPageDelivered(ctx reqcontext.RequestContext, conversationID string, messages []database.Message) {
+	var received []string
+	for _, message := range messages {
+		if message.SenderId != ctx.UserID {
+			received = append(received, message.Id)
+		}
+	}
+	delivered, err := rt.db.MarkListedMessagesAsDelivered(ctx.Context, ctx.UserID, received)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to mark messages as delivered")
+	} else if len(delivered) > 0 {
+		rt.publishEvent(ctx, events.MessagesDelivered, conversationID, DeliveryEvent{UserID: ctx.UserID})
+	}
+}
+
+func parseMessagePage(r *http.Request) (database.MessagePage, error) {
+	query := r.URL.Query()
+	page := database.MessagePage{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Limit:  defaultMessagePageSize,
+	}
+	if page.Before != "" && page.After != "" {
+		return page, errors.New("before and after cannot be used together")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxMessagePageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxMessagePageSize)
+		}
+		page.Limit = n
+	}
+	return page, nil
+}
+
 func (rt *_router) sendMessage(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -114,6 +209,9 @@ func (rt *_router) sendMessage(
 		http.Error(w, "Missing conversationId", http.StatusBadRequest)
 		return
 	}
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
 	err := r.ParseMultipartForm(32 << 20)
 	if err != nil {
 		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
@@ -122,6 +220,7 @@ func (rt *_router) sendMessage(
 	content := r.FormValue("content")
 	replyTo := r.FormValue("replyTo")
 	var attachment []byte
+	var attachmentType string
 	file, header, err := r.FormFile("attachment")
 	if err == nil {
 		defer file.Close()
@@ -130,7 +229,8 @@ func (rt *_router) sendMessage(
 			"image/png":  true,
 			"image/gif":  true,
 		}
-		if !allowedTypes[header.Header.Get("Content-Type")] {
+		attachmentType = header.Header.Get("Content-Type")
+		if !allowedTypes[attachmentType] {
 			http.Error(w, "Invalid file type. Only images and GIFs are allowed", http.StatusBadRequest)
 			return
 		}
@@ -149,40 +249,36 @@ func (rt *_router) sendMessage(
 		http.Error(w, "Message content or attachment is required", http.StatusBadRequest)
 		return
 	}
-	senderID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	senderID := ctx.UserID
 	messageID, err := generateNewID()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate message ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to generate message ID")
 		return
 	}
-	message, err := rt.db.SaveMessage(conversationID, senderID, messageID, content, attachment, replyTo)
+	var attachmentID string
+	if len(attachment) > 0 {
+		attachmentID, err = rt.storeMedia(ctx, attachment, attachmentType)
+		if err != nil {
+			rt.internalError(w, ctx, err, "Failed to store attachment")
+			return
+		}
+	}
+	message, err := rt.db.SaveMessage(ctx.Context, conversationID, senderID, messageID, content, attachmentID, replyTo)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to save message")
+		rt.discardMedia(ctx, attachmentID)
 		if errors.Is(err, database.ErrConversationDoesNotExist) {
 			http.Error(w, "Conversation does not exist", http.StatusNotFound)
+		} else if errors.Is(err, database.ErrInvalidReplyTarget) {
+			http.Error(w, "Reply target does not exist in this conversation", http.StatusBadRequest)
 		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to save message")
 		}
 		return
 	}
-	members, err := rt.db.GetConversationMembers(conversationID)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch conversation members")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	for _, memberID := range members {
-		if memberID != senderID {
-			if err := rt.db.InsertDeliveryReceipt(messageID, memberID, message.Timestamp); err != nil {
-				ctx.Logger.WithError(err).Error("Failed to insert delivery receipt")
-			}
-		}
-	}
+	message.SenderName = ctx.User.Name
+	message.SenderPhotoId = ctx.User.PhotoId
+	rt.setTyping(ctx, conversationID, false)
+	rt.publishEvent(ctx, events.MessageCreated, conversationID, message)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(message); err != nil {
 		ctx.Logger.WithError(err).Error("Failed to encode response")
@@ -195,16 +291,31 @@ func (rt *_router) getMyConversations(
 	ps httprouter.Params,
 	ctx reqcontext.RequestContext,
 ) {
-	userID, err := rt.getAuthenticatedUserID(r)
+	userID := ctx.UserID
+	conversations, err := rt.db.GetMyConversations(ctx.Context, userID)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		rt.internalError(w, ctx, err, "Failed to fetch user's conversations")
 		return
 	}
-	conversations, err := rt.db.GetMyConversations(userID)
+	// Only the last messages reach the client with the list; the rest are
+	// delivered when the conversation is opened or pushed over the stream.
+	var listed []string
+	conversationOf := map[string]string{}
+	for _, conversation := range conversations {
+		if last := conversation.LastMessage; last != nil && last.SenderId != userID {
+			listed = append(listed, last.Id)
+			conversationOf[last.Id] = conversation.Id
+		}
+	}
+	delivered, err := rt.db.MarkListedMessagesAsDelivered(ctx.Context, userID, listed)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch user's conversations")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		ctx.Logger.WithError(err).Error("Failed to mark messages as delivered")
+	}
+	for _, messageID := range delivered {
+		rt.publishEvent(ctx, events.MessagesDelivered, conversationOf[messageID], DeliveryEvent{
+			UserID:    userID,
+			MessageID: messageID,
+		})
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(conversations); err != nil {
@@ -220,33 +331,41 @@ func (rt *_router) deleteMessage(
 ) {
 	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	userID := ctx.UserID
+	scope := r.URL.Query().Get("scope")
+	if scope != "" && scope != deleteForMe && scope != deleteForEveryone {
+		http.Error(w, "Invalid scope, expected 'me' or 'everyone'", http.StatusBadRequest)
 		return
 	}
-	if ok, err := rt.db.IsUserInConversation(conversationID, userID); !ok {
-		if err != nil {
-			ctx.Logger.WithError(err).Error("Failed to check conversation membership")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if scope == deleteForMe {
+		if err := rt.db.HideMessage(ctx.Context, conversationID, messageID, userID); errors.Is(err, database.ErrMessageDoesNotExist) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			rt.internalError(w, ctx, err, "Failed to hide message")
 			return
 		}
-		http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+		// Only the caller's other sessions need to know.
+		rt.events.Publish(events.MessageHidden, conversationID, MessageEvent{MessageID: messageID}, []string{userID})
+		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	err = rt.db.DeleteMessage(conversationID, messageID, userID)
+	err := rt.db.DeleteMessage(ctx.Context, conversationID, messageID, userID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to delete message")
 		if errors.Is(err, database.ErrMessageDoesNotExist) {
 			http.Error(w, "Message not found", http.StatusNotFound)
 		} else if errors.Is(err, database.ErrUnauthorizedToDeleteMessage) {
 			http.Error(w, "Forbidden: You are not the sender of this message", http.StatusForbidden)
 		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to delete message")
 		}
 		return
 	}
+	rt.publishEvent(ctx, events.MessageDeleted, conversationID, MessageEvent{MessageID: messageID})
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -256,68 +375,113 @@ func (rt *_router) forwardMessage(
 	ps httprouter.Params,
 	ctx reqcontext.RequestContext,
 ) {
+	conversationID := ps.ByName("conversationId")
 	messageID := ps.ByName("messageId")
-	var req struct {
-		TargetConversationID string `json:"targetConversationId"`
-		ForwarderName        string `json:"forwarderName"`
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
 	}
+	var req ForwardMessageRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	currentUserID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	targets := req.targets()
+	if len(targets) == 0 {
+		http.Error(w, "Missing targetConversationIds", http.StatusBadRequest)
+		return
+	} else if len(targets) > maxForwardTargets {
+		http.Error(w, fmt.Sprintf("A message can be forwarded to at most %d conversations at once", maxForwardTargets), http.StatusBadRequest)
 		return
 	}
-	originalMessage, err := rt.db.GetMessage(messageID, currentUserID)
-	if err != nil {
-		if errors.Is(err, database.ErrMessageDoesNotExist) {
-			http.Error(w, "Message not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	originalMessage, ok := rt.getConversationMessage(w, ctx, conversationID, messageID)
+	if !ok {
+		return
+	}
+	if originalMessage.Deleted {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return
+	}
+	if originalMessage.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be forwarded", http.StatusBadRequest)
+		return
+	}
+	for _, target := range targets {
+		if !rt.requireConversationMember(w, ctx, target) {
+			return
 		}
+	}
+	forwardTargets := make([]database.ForwardTarget, 0, len(targets))
+	for _, target := range targets {
+		newMessageID, err := generateNewID()
+		if err != nil {
+			rt.internalError(w, ctx, err, "Failed to generate new message ID")
+			return
+		}
+		forwardTargets = append(forwardTargets, database.ForwardTarget{ConversationId: target, MessageId: newMessageID})
+	}
+	forwarded, err := rt.db.ForwardMessage(ctx.Context, ctx.UserID, messageID, forwardTargets)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to save forwarded messages")
 		return
 	}
-	newMessageID, err := generateNewID()
-	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate new message ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	newContent := "<strong>Forwarded from " + req.ForwarderName + ":</strong> " + originalMessage.Content
-	newMessage := database.Message{
-		Id:             newMessageID,
-		ConversationId: req.TargetConversationID,
-		SenderId:       currentUserID,
-		SenderName:     req.ForwarderName,
-		Content:        newContent,
-		Timestamp:      time.Now().Format(time.RFC3339),
-		Attachment:     originalMessage.Attachment,
-	}
-	if _, err := rt.db.SaveMessage(
-		newMessage.ConversationId,
-		newMessage.SenderId,
-		newMessage.Id,
-		newMessage.Content,
-		newMessage.Attachment,
-		"",
-	); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to save forwarded message")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	members, err := rt.db.GetConversationMembers(req.TargetConversationID)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch conversation members for forwarded message")
-	} else {
-		for _, memberID := range members {
-			if memberID != currentUserID {
-				if err := rt.db.InsertDeliveryReceipt(newMessageID, memberID, newMessage.Timestamp); err != nil {
-					ctx.Logger.WithError(err).Error("Failed to insert delivery receipt for forwarded message")
-				}
-			}
+	// Events go out only once every copy is committed.
+	for i := range forwarded {
+		forwarded[i].SenderPhotoId = ctx.User.PhotoId
+		rt.publishEvent(ctx, events.MessageCreated, forwarded[i].ConversationId, forwarded[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(forwarded); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode forwarded messages")
+	}
+}
+
+// targets returns the requested conversations without duplicates.
+func (req ForwardMessageRequest) targets() []string {
+	seen := map[string]bool{}
+	var targets []string
+	for _, id := range append(req.TargetConversationIDs, req.TargetConversationID) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			targets = append(targets, id)
 		}
 	}
-	w.WriteHeader(http.StatusOK)
+	return targets
+}
+
+func (rt *_router) requireConversationMember(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	conversationID string,
+) bool {
+	isMember, err := rt.db.IsUserInConversation(ctx.Context, conversationID, ctx.UserID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to check conversation membership")
+		return false
+	}
+	if !isMember {
+		http.Error(w, "Forbidden: You are not a member of this conversation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (rt *_router) getConversationMessage(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	conversationID string,
+	messageID string,
+) (database.Message, bool) {
+	message, err := rt.db.GetMessage(ctx.Context, messageID, ctx.UserID)
+	if errors.Is(err, database.ErrMessageDoesNotExist) || (err == nil && message.ConversationId != conversationID) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return database.Message{}, false
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch message")
+		return database.Message{}, false
+	}
+	return message, true
 }
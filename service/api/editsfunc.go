@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+func (rt *_router) editMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	var req EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	message, ok := rt.getConversationMessage(w, ctx, conversationID, messageID)
+	if !ok {
+		return
+	}
+	if message.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be edited", http.StatusBadRequest)
+		return
+	}
+	if message.Deleted {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return
+	}
+	if message.SenderId != ctx.UserID {
+		http.Error(w, "Forbidden: You are not the sender of this message", http.StatusForbidden)
+		return
+	}
+	if rt.messageEditWindow > 0 {
+		sentAt, err := time.Parse(time.RFC3339, message.Timestamp)
+		if err != nil {
+			rt.internalError(w, ctx, err, "Failed to parse message timestamp")
+			return
+		}
+		if time.Since(sentAt) > rt.messageEditWindow {
+			http.Error(w, "Forbidden: The edit window for this message has expired", http.StatusForbidden)
+			return
+		}
+	}
+	if strings.TrimSpace(req.Content) == "" && message.AttachmentId == "" {
+		http.Error(w, "Message content is required", http.StatusBadRequest)
+		return
+	}
+	message.SenderPhotoId = ctx.User.PhotoId
+	if req.Content != message.Content {
+		editedAt, err := rt.db.EditMessage(ctx.Context, messageID, req.Content)
+		if errors.Is(err, database.ErrMessageDoesNotExist) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			rt.internalError(w, ctx, err, "Failed to edit message")
+			return
+		}
+		message.Content = req.Content
+		message.Edited = true
+		message.EditedAt = editedAt
+		rt.publishEvent(ctx, events.MessageEdited, conversationID, message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(message); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode message")
+	}
+}
+
+func (rt *_router) getMessageEdits(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if _, ok := rt.getConversationMessage(w, ctx, conversationID, messageID); !ok {
+		return
+	}
+	edits, err := rt.db.GetMessageEdits(ctx.Context, messageID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch message revisions")
+		return
+	}
+	if edits == nil {
+		edits = []database.MessageEdit{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(MessageEdits{
+		MessageID: messageID,
+		Revisions: edits,
+	}); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode message revisions")
+	}
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/events"
+)
+
+const (
+	eventStreamHeartbeat = 15 * time.Second
+	// eventStreamWriteTimeout bounds each write to an event stream, which is
+	// exempt from the server write timeout.
+	eventStreamWriteTimeout = 10 * time.Second
+)
+
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context of its requests so that
+// long-lived responses can manage their own write deadline. It is meant to
+// be used as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// extendWriteDeadline gives the next writes on the request's connection
+// eventStreamWriteTimeout to complete, replacing the server write timeout.
+func extendWriteDeadline(r *http.Request) error {
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(eventStreamWriteTimeout))
+}
+
+// streamEvents delivers events for the caller's conversations as
+// Server-Sent Events. The stream replaces the server write timeout with a
+// per-write deadline and is closed after the configured duration; clients
+// reconnect with Last-Event-ID (or ?lastEventId=) to resume.
+func (rt *_router) streamEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastEventID, err := parseLastEventID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, missed, complete, err := rt.events.Subscribe(ctx.UserID, lastEventID)
+	if errors.Is(err, events.ErrHubClosed) {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to subscribe to events")
+		return
+	}
+	defer rt.events.Unsubscribe(sub)
+	defer rt.presence.Connect(ctx.UserID)()
+
+	if err := extendWriteDeadline(r); err != nil {
+		ctx.Logger.WithError(err).Debug("Failed to extend event stream write deadline")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, "retry: 1000\n\n"); err != nil {
+		return
+	}
+	if !complete {
+		// Some events were lost; tell the client to reload its state.
+		if _, err := fmt.Fprint(w, "event: resync\ndata: {}\n\n"); err != nil {
+			return
+		}
+	}
+	for _, event := range missed {
+		if err := writeEvent(w, event); err != nil {
+			ctx.Logger.WithError(err).Debug("Failed to write event")
+			return
+		}
+		rt.markPushedDelivered(ctx, event)
+	}
+	flusher.Flush()
+
+	deadline := time.NewTimer(rt.eventStreamDuration)
+	defer deadline.Stop()
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			return
+		case <-heartbeat.C:
+			if err := extendWriteDeadline(r); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case event, open := <-sub.C:
+			if !open {
+				return
+			}
+			if err := extendWriteDeadline(r); err != nil {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				ctx.Logger.WithError(err).Debug("Failed to write event")
+				return
+			}
+			rt.markPushedDelivered(ctx, event)
+		}
+		flusher.Flush()
+	}
+}
+
+func parseLastEventID(r *http.Request) (uint64, error) {
+	raw := r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = r.URL.Query().Get("lastEventId")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid last event id")
+	}
+	return id, nil
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if event.Id == 0 {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+// publishEvent sends an event to the current members of the conversation
+// plus any extra recipients, e.g. a member who was just removed.
+func (rt *_router) publishEvent(
+	ctx reqcontext.RequestContext,
+	eventType string,
+	conversationID string,
+	payload interface{},
+	extraRecipients ...string,
+) {
+	members, err := rt.db.GetConversationMembers(ctx.Context, conversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to resolve event recipients")
+		return
+	}
+	rt.events.Publish(eventType, conversationID, payload, append(members, extraRecipients...))
+}
@@ -1,23 +1,46 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
 
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
 )
 
 func (rt *_router) Close() error {
+	rt.events.Close()
 	return nil
 }
 
 func (rt *_router) liveness(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if err := rt.db.Ping(); err != nil {
+	if err := rt.db.Ping(r.Context()); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// internalError logs err and answers with a server error. Database
+// operations that timed out are reported as 503, and those canceled
+// because the client went away are not logged as failures.
+func (rt *_router) internalError(w http.ResponseWriter, ctx reqcontext.RequestContext, err error, message string) {
+	switch {
+	case errors.Is(err, database.ErrQueryCanceled):
+		ctx.Logger.WithError(err).Debug(message)
+		http.Error(w, "Request canceled", http.StatusServiceUnavailable)
+	case errors.Is(err, database.ErrQueryTimeout):
+		ctx.Logger.WithError(err).Warning(message)
+		http.Error(w, "Database timed out", http.StatusServiceUnavailable)
+	default:
+		ctx.Logger.WithError(err).Error(message)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
 func generateNewID() (string, error) {
 	uid, err := uuid.NewV4()
 	if err != nil {
@@ -25,3 +48,11 @@ func generateNewID() (string, error) {
 	}
 	return uid.String(), nil
 }
+
+func generateSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
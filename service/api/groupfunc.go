@@ -9,6 +9,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/tassdam/wasa/service/api/reqcontext"
 	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
 )
 
 func (rt *_router) createGroup(
@@ -38,22 +39,31 @@ func (rt *_router) createGroup(
 	defer file.Close()
 	photo, err := io.ReadAll(file)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to read image file")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to read image file")
 		return
 	}
 	conversationID, err := generateNewID()
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to generate conversation ID")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to generate conversation ID")
 		return
 	}
-	err = rt.db.CreateGroupConversation(conversationID, members, name, photo)
+	photoID, err := rt.storeMedia(ctx, photo, "")
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to create new conversation")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to store group photo")
 		return
 	}
+	err = rt.db.CreateGroupConversation(ctx.Context, conversationID, ctx.UserID, members, name, photoID)
+	if err != nil {
+		rt.discardMedia(ctx, photoID)
+	}
+	if errors.Is(err, database.ErrUserDoesNotExist) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to create new conversation")
+		return
+	}
+	rt.publishEvent(ctx, events.ConversationCreated, conversationID, nil)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]string{
 		"conversationId": conversationID,
@@ -68,15 +78,10 @@ func (rt *_router) getMyGroups(
 	ps httprouter.Params,
 	ctx reqcontext.RequestContext,
 ) {
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	conversations, err := rt.db.GetMyGroups(userID)
+	userID := ctx.UserID
+	conversations, err := rt.db.GetMyGroups(ctx.Context, userID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to fetch user's conversations")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to fetch user's conversations")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -92,34 +97,33 @@ func (rt *_router) getGroup(
 	ctx reqcontext.RequestContext,
 ) {
 	groupID := ps.ByName("groupId")
-	_, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	role, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner, database.RoleAdmin, database.RoleMember)
+	if !ok {
 		return
 	}
-	group, dbErr := rt.db.GetGroupInfo(groupID)
+	group, dbErr := rt.db.GetGroupInfo(ctx.Context, groupID)
 	if dbErr != nil {
 		if errors.Is(dbErr, database.ErrGroupDoesNotExist) {
 			http.Error(w, "Group not found", http.StatusNotFound)
 			return
 		}
-		ctx.Logger.WithError(dbErr).Error("Failed to fetch group details")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, dbErr, "Failed to fetch group details")
 		return
 	}
 	response := map[string]interface{}{
-		"id":      group.Id,
-		"name":    group.Name,
-		"members": group.Members,
+		"id":          group.Id,
+		"name":        group.Name,
+		"members":     group.Members,
+		"memberRoles": group.MemberRoles,
+		"myRole":      role,
 	}
-	if group.ConversationPhoto.Valid {
-		response["groupPhoto"] = group.ConversationPhoto.String
+	if group.ConversationPhotoId != "" {
+		response["groupPhotoId"] = group.ConversationPhotoId
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to encode group response")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to encode group response")
 	}
 }
 
@@ -133,12 +137,10 @@ func (rt *_router) setGroupName(
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	_, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	groupID := ps.ByName("groupId")
+	if _, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner, database.RoleAdmin); !ok {
 		return
 	}
-	groupID := ps.ByName("groupId")
 	var req UpdateGroupRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -148,15 +150,15 @@ func (rt *_router) setGroupName(
 		http.Error(w, "Invalid group name length", http.StatusBadRequest)
 		return
 	}
-	dbErr := rt.db.UpdateGroupName(groupID, req.Name)
-	if errors.Is(dbErr, database.ErrUserDoesNotExist) {
-		http.Error(w, "User not found", http.StatusNotFound)
+	dbErr := rt.db.UpdateGroupName(ctx.Context, groupID, req.Name)
+	if errors.Is(dbErr, database.ErrGroupDoesNotExist) {
+		http.Error(w, "Group not found", http.StatusNotFound)
 		return
 	} else if dbErr != nil {
-		ctx.Logger.WithError(dbErr).Error("failed to update username")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, dbErr, "failed to update group name")
 		return
 	}
+	rt.publishEvent(ctx, events.GroupUpdated, groupID, GroupChange{Change: "name", Name: req.Name})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 }
@@ -172,12 +174,10 @@ func (rt *_router) setGroupPhoto(
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	_, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner, database.RoleAdmin); !ok {
 		return
 	}
-	err = r.ParseMultipartForm(10 * 1024 * 1024)
+	err := r.ParseMultipartForm(10 * 1024 * 1024)
 	if err != nil {
 		http.Error(w, "Failed to parse form. Ensure the file is below 10 MB.", http.StatusBadRequest)
 		return
@@ -202,17 +202,26 @@ func (rt *_router) setGroupPhoto(
 		http.Error(w, "Invalid file type. Only JPEG and PNG are supported.", http.StatusUnsupportedMediaType)
 		return
 	}
-	err = rt.db.UpdateGroupPhoto(groupID, photoData)
-	if errors.Is(err, database.ErrUserDoesNotExist) {
-		http.Error(w, "User not found", http.StatusNotFound)
+	photoID, err := rt.storeMedia(ctx, photoData, fileType)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to store group photo")
+		return
+	}
+	err = rt.db.UpdateGroupPhoto(ctx.Context, groupID, photoID)
+	if err != nil {
+		rt.discardMedia(ctx, photoID)
+	}
+	if errors.Is(err, database.ErrGroupDoesNotExist) {
+		http.Error(w, "Group not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to update user photo")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to update group photo")
 		return
 	}
+	rt.publishEvent(ctx, events.GroupUpdated, groupID, GroupChange{Change: "photo", PhotoID: photoID})
 	response := map[string]string{
 		"message": "Photo updated successfully",
+		"photoId": photoID,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -228,25 +237,25 @@ func (rt *_router) leaveGroup(
 	ctx reqcontext.RequestContext,
 ) {
 	groupID := ps.ByName("groupId")
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	userID := ctx.UserID
+	err := rt.db.LeaveGroup(ctx.Context, groupID, userID)
+	if errors.Is(err, database.ErrGroupDoesNotExist) {
+		http.Error(w, "Group not found", http.StatusNotFound)
 		return
-	}
-	err = rt.db.LeaveGroup(groupID, userID)
-	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to leave group")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	} else if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "Forbidden: You are not a member of this group", http.StatusForbidden)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to leave group")
 		return
 	}
+	rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" left the group", GroupChange{Change: "member_left", UserID: userID})
 	w.WriteHeader(http.StatusOK)
 }
 
 func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	groupID := ps.ByName("groupId")
-	_, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if _, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner, database.RoleAdmin); !ok {
 		return
 	}
 	var request struct {
@@ -256,11 +265,223 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
 		http.Error(w, "Invalid request format", http.StatusBadRequest)
 		return
 	}
-	err = rt.db.AddUserToGroup(groupID, request.UserID)
+	user, err := rt.db.GetUserById(ctx.Context, request.UserID)
+	if errors.Is(err, database.ErrUserDoesNotExist) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch user")
+		return
+	}
+	if isMember, err := rt.db.IsUserInConversation(ctx.Context, groupID, request.UserID); err != nil {
+		rt.internalError(w, ctx, err, "Failed to check group membership")
+		return
+	} else if isMember {
+		http.Error(w, "User is already a member of this group", http.StatusConflict)
+		return
+	}
+	err = rt.db.AddUserToGroup(ctx.Context, groupID, request.UserID)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to add user to group")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to add user to group")
 		return
 	}
+	rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" added "+user.Name, GroupChange{Change: "member_added", UserID: user.Id})
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (rt *_router) requireGroupRole(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	groupID string,
+	allowed ...string,
+) (string, bool) {
+	role, err := rt.db.GetMemberRole(ctx.Context, groupID, ctx.UserID)
+	if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "Forbidden: You are not a member of this group", http.StatusForbidden)
+		return "", false
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to check group membership")
+		return "", false
+	}
+	for _, a := range allowed {
+		if role == a {
+			return role, true
+		}
+	}
+	http.Error(w, "Forbidden: Insufficient group role", http.StatusForbidden)
+	return role, false
+}
+
+func (rt *_router) removeFromGroup(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	groupID := ps.ByName("groupId")
+	targetID := ps.ByName("userId")
+	actorRole, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner, database.RoleAdmin)
+	if !ok {
+		return
+	}
+	if targetID == ctx.UserID {
+		http.Error(w, "Use DELETE /groups/{groupId} to leave the group", http.StatusBadRequest)
+		return
+	}
+	target, targetRole, ok := rt.getGroupMember(w, ctx, groupID, targetID)
+	if !ok {
+		return
+	}
+	if targetRole == database.RoleOwner || (targetRole == database.RoleAdmin && actorRole != database.RoleOwner) {
+		http.Error(w, "Forbidden: Insufficient group role", http.StatusForbidden)
+		return
+	}
+	err := rt.db.RemoveGroupMember(ctx.Context, groupID, ctx.UserID, targetID)
+	if errors.Is(err, database.ErrInsufficientGroupRole) {
+		http.Error(w, "Forbidden: Insufficient group role", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to remove user from group")
+		return
+	}
+	rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" removed "+target.Name, GroupChange{Change: "member_removed", UserID: targetID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) setGroupMemberRole(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	groupID := ps.ByName("groupId")
+	targetID := ps.ByName("userId")
+	if _, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner); !ok {
+		return
+	}
+	var req UpdateMemberRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role != database.RoleAdmin && req.Role != database.RoleMember {
+		http.Error(w, "Role must be 'admin' or 'member'", http.StatusBadRequest)
+		return
+	}
+	target, targetRole, ok := rt.getGroupMember(w, ctx, groupID, targetID)
+	if !ok {
+		return
+	}
+	if targetRole == database.RoleOwner {
+		http.Error(w, "Use PUT /groups/{groupId}/owner to transfer ownership", http.StatusBadRequest)
+		return
+	}
+	if targetRole == req.Role {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	err := rt.db.SetMemberRole(ctx.Context, groupID, ctx.UserID, targetID, req.Role)
+	if errors.Is(err, database.ErrInsufficientGroupRole) {
+		http.Error(w, "Forbidden: Insufficient group role", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to update member role")
+		return
+	}
+	change := GroupChange{Change: "role", UserID: targetID, Role: req.Role}
+	if req.Role == database.RoleAdmin {
+		rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" made "+target.Name+" an admin", change)
+	} else {
+		rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" removed "+target.Name+" as admin", change)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) transferGroupOwnership(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	groupID := ps.ByName("groupId")
+	if _, ok := rt.requireGroupRole(w, ctx, groupID, database.RoleOwner); !ok {
+		return
+	}
+	var req TransferOwnershipRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" || req.UserID == ctx.UserID {
+		http.Error(w, "Ownership must be transferred to another member", http.StatusBadRequest)
+		return
+	}
+	target, _, ok := rt.getGroupMember(w, ctx, groupID, req.UserID)
+	if !ok {
+		return
+	}
+	err := rt.db.TransferGroupOwnership(ctx.Context, groupID, ctx.UserID, req.UserID)
+	if errors.Is(err, database.ErrInsufficientGroupRole) {
+		http.Error(w, "Forbidden: Insufficient group role", http.StatusForbidden)
+		return
+	} else if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to transfer group ownership")
+		return
+	}
+	rt.recordGroupEvent(ctx, groupID, ctx.User.Name+" made "+target.Name+" the group owner", GroupChange{Change: "owner", UserID: req.UserID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) getGroupMember(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	groupID string,
+	userID string,
+) (database.User, string, bool) {
+	role, err := rt.db.GetMemberRole(ctx.Context, groupID, userID)
+	if errors.Is(err, database.ErrUserNotInConversation) {
+		http.Error(w, "User is not a member of this group", http.StatusNotFound)
+		return database.User{}, "", false
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch member role")
+		return database.User{}, "", false
+	}
+	user, err := rt.db.GetUserById(ctx.Context, userID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch group member")
+		return database.User{}, "", false
+	}
+	return user, role, true
+}
+
+func (rt *_router) recordGroupEvent(ctx reqcontext.RequestContext, groupID string, content string, change GroupChange) {
+	rt.publishEvent(ctx, events.GroupUpdated, groupID, change, change.UserID)
+	rt.postSystemMessage(ctx, groupID, content)
+}
+
+// postSystemMessage records an announcement by the caller in the
+// conversation. Failures are only logged, as the change it announces has
+// already been made.
+func (rt *_router) postSystemMessage(ctx reqcontext.RequestContext, conversationID string, content string) {
+	messageID, err := generateNewID()
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to generate system message ID")
+		return
+	}
+	message, err := rt.db.SaveSystemMessage(ctx.Context, conversationID, ctx.UserID, messageID, content)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to save system message")
+		return
+	}
+	message.SenderName = ctx.User.Name
+	rt.publishEvent(ctx, events.MessageCreated, conversationID, message)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/tassdam/wasa/service/api/reqcontext"
@@ -31,33 +32,49 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 		http.Error(w, "Invalid photo data", http.StatusBadRequest)
 		return
 	}
-	user, err := rt.db.GetUserByName(req.Name)
+	user, err := rt.db.GetUserByName(ctx.Context, req.Name)
 	if errors.Is(err, database.ErrUserDoesNotExist) {
 		newID, genErr := generateNewID()
 		if genErr != nil {
-			ctx.Logger.WithError(genErr).Error("Failed to generate user ID")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, genErr, "Failed to generate user ID")
 			return
 		}
 		newUser := database.User{
-			Id:    newID,
-			Name:  req.Name,
-			Photo: photoBytes,
+			Id:   newID,
+			Name: req.Name,
 		}
-		createdUser, createErr := rt.db.CreateUser(newUser)
+		if len(photoBytes) > 0 {
+			newUser.PhotoId, genErr = rt.storeMedia(ctx, photoBytes, "")
+			if genErr != nil {
+				rt.internalError(w, ctx, genErr, "Failed to store user photo")
+				return
+			}
+		}
+		createdUser, createErr := rt.db.CreateUser(ctx.Context, newUser)
 		if createErr != nil {
-			ctx.Logger.WithError(createErr).Error("cannot create user")
-			http.Error(w, "Internal Server Error: cannot create user", http.StatusInternalServerError)
+			rt.discardMedia(ctx, newUser.PhotoId)
+			rt.internalError(w, ctx, createErr, "cannot create user")
 			return
 		}
 		user = createdUser
 	} else if err != nil {
-		ctx.Logger.WithError(err).Error("error retrieving user")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "error retrieving user")
+		return
+	}
+	token, err := generateSessionToken()
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to generate session token")
+		return
+	}
+	expiresAt := time.Now().Add(rt.sessionTTL)
+	if err := rt.db.CreateSession(ctx.Context, token, user.Id, expiresAt); err != nil {
+		rt.internalError(w, ctx, err, "cannot create session")
 		return
 	}
 	resp := LoginResponse{
 		Identifier: user.Id,
+		Token:      token,
+		ExpiresAt:  expiresAt.Format(time.RFC3339),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -66,3 +83,16 @@ func (rt *_router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter
 		return
 	}
 }
+
+func (rt *_router) doLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	token, err := getBearerToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := rt.db.DeleteSession(ctx.Context, token); err != nil {
+		rt.internalError(w, ctx, err, "cannot delete session")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+)
+
+func (rt *_router) storeMedia(ctx reqcontext.RequestContext, data []byte, contentType string) (string, error) {
+	mediaID, err := generateNewID()
+	if err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	media, err := rt.db.CreateMedia(ctx.Context, mediaID, contentType, data)
+	if err != nil {
+		return "", err
+	}
+	return media.Id, nil
+}
+
+// discardMedia deletes media stored for a change that then failed. It does
+// not use the request context, which may be the reason the change failed.
+func (rt *_router) discardMedia(ctx reqcontext.RequestContext, mediaID string) {
+	if err := rt.db.DeleteMediaIfUnused(context.Background(), mediaID); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to delete unused media")
+	}
+}
+
+func (rt *_router) getMedia(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	mediaID := ps.ByName("mediaId")
+	// Media the caller may not see is reported as missing, so that ids of
+	// other conversations' attachments cannot be probed.
+	allowed, err := rt.db.CanUserAccessMedia(ctx.Context, mediaID, ctx.UserID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to check media access")
+		return
+	} else if !allowed {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	}
+	media, err := rt.db.GetMedia(ctx.Context, mediaID)
+	if errors.Is(err, database.ErrMediaDoesNotExist) {
+		http.Error(w, "Media not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch media")
+		return
+	}
+	etag := `"` + media.Sha256 + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	data, err := rt.db.GetMediaData(ctx.Context, media)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch media content")
+		return
+	}
+	w.Header().Set("Content-Type", servedContentType(media.ContentType))
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(data)), 10))
+	if _, err := w.Write(data); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to write media")
+	}
+}
+
+// servedContentType lets browsers render raster images inline and makes
+// them download anything else. SVG is excluded because it can carry scripts.
+func servedContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "image/") || mediaType == "image/svg+xml" {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+const pinPreviewRunes = 40
+
+func (rt *_router) pinMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	message, ok := rt.getConversationMessage(w, ctx, conversationID, messageID)
+	if !ok {
+		return
+	}
+	if message.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be pinned", http.StatusBadRequest)
+		return
+	}
+	if message.Deleted {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return
+	}
+	pinned, err := rt.db.PinMessage(ctx.Context, conversationID, messageID, ctx.UserID, maxPinnedMessages)
+	if errors.Is(err, database.ErrTooManyPinnedMessages) {
+		http.Error(w, "Conversation already has the maximum number of pinned messages", http.StatusConflict)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to pin message")
+		return
+	}
+	pins, ok := rt.getPinnedMessages(w, ctx, conversationID)
+	if !ok {
+		return
+	}
+	if pinned {
+		rt.publishEvent(ctx, events.MessagePinned, conversationID, PinEvent{
+			MessageID:      messageID,
+			UserID:         ctx.UserID,
+			PinnedMessages: pins,
+		})
+		rt.postSystemMessage(ctx, conversationID, ctx.User.Name+" pinned "+pinPreview(message))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pins); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode pinned messages")
+	}
+}
+
+func (rt *_router) unpinMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	unpinned, err := rt.db.UnpinMessage(ctx.Context, conversationID, messageID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to unpin message")
+		return
+	}
+	if !unpinned {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+	pins, ok := rt.getPinnedMessages(w, ctx, conversationID)
+	if !ok {
+		return
+	}
+	rt.publishEvent(ctx, events.MessageUnpinned, conversationID, PinEvent{
+		MessageID:      messageID,
+		UserID:         ctx.UserID,
+		PinnedMessages: pins,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pins); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode pinned messages")
+	}
+}
+
+func (rt *_router) getPinnedMessages(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	conversationID string,
+) ([]database.PinnedMessage, bool) {
+	pins, err := rt.db.GetPinnedMessages(ctx.Context, conversationID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch pinned messages")
+		return nil, false
+	}
+	if pins == nil {
+		pins = []database.PinnedMessage{}
+	}
+	return pins, true
+}
+
+// pinPreview quotes the start of a message for the pin announcement.
+func pinPreview(message database.Message) string {
+	content := strings.Join(strings.Fields(message.Content), " ")
+	if content == "" {
+		return "a message"
+	}
+	if runes := []rune(content); len(runes) > pinPreviewRunes {
+		content = string(runes[:pinPreviewRunes]) + "…"
+	}
+	return "\"" + content + "\""
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+const maxPresenceUsers = 100
+
+func (rt *_router) getPresence(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	userIDs := r.URL.Query()["userId"]
+	if len(userIDs) == 0 {
+		userIDs = []string{ctx.UserID}
+	}
+	if len(userIDs) > maxPresenceUsers {
+		http.Error(w, "Too many users requested", http.StatusBadRequest)
+		return
+	}
+	// Presence is only shared with users who have a conversation in
+	// common; anyone else is reported as not found.
+	partners, err := rt.db.GetConversationPartners(ctx.Context, ctx.UserID, userIDs)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to check presence access")
+		return
+	}
+	for _, id := range userIDs {
+		if id != ctx.UserID && !partners[id] {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	}
+	statuses, err := rt.presenceStatuses(ctx, userIDs)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch presence")
+		return
+	}
+	response := make([]PresenceStatus, 0, len(statuses))
+	for _, id := range userIDs {
+		if status, ok := statuses[id]; ok {
+			response = append(response, status)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode presence response")
+	}
+}
+
+func (rt *_router) setPresenceVisibility(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	var req UpdatePresenceVisibilityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Visible == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err := rt.db.SetPresenceVisibility(ctx.Context, ctx.UserID, *req.Visible)
+	if errors.Is(err, database.ErrUserDoesNotExist) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to update presence visibility")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) startTyping(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	rt.setTyping(ctx, conversationID, true)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) stopTyping(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	rt.setTyping(ctx, conversationID, false)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setTyping updates the caller's typing state and tells the other members
+// when it changes. Typing indicators are ephemeral and never replayed.
+func (rt *_router) setTyping(ctx reqcontext.RequestContext, conversationID string, typing bool) {
+	if !rt.presence.SetTyping(conversationID, ctx.UserID, typing) {
+		return
+	}
+	members, err := rt.db.GetConversationMembers(ctx.Context, conversationID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to resolve typing recipients")
+		return
+	}
+	recipients := make([]string, 0, len(members))
+	for _, m := range members {
+		if m != ctx.UserID {
+			recipients = append(recipients, m)
+		}
+	}
+	rt.events.Notify(events.Typing, conversationID, TypingEvent{UserID: ctx.UserID, Typing: typing}, recipients)
+}
+
+// presenceStatuses resolves the presence of the given users as seen by
+// the caller. Users who hide their presence only see their own; unknown
+// users are left out.
+func (rt *_router) presenceStatuses(ctx reqcontext.RequestContext, userIDs []string) (map[string]PresenceStatus, error) {
+	visibility, err := rt.db.GetPresenceVisibility(ctx.Context, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]PresenceStatus, len(visibility))
+	for id, visible := range visibility {
+		status := PresenceStatus{UserID: id, Visible: visible}
+		if visible || id == ctx.UserID {
+			online, lastSeen := rt.presence.Status(id)
+			status.Online = online
+			if !lastSeen.IsZero() {
+				status.LastSeen = lastSeen.Format(time.RFC3339)
+			}
+		}
+		statuses[id] = status
+	}
+	return statuses, nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+const (
+	defaultReaction  = "❤️"
+	maxReactionRunes = 16
+)
+
+func (rt *_router) getReactions(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if _, ok := rt.getConversationMessage(w, ctx, conversationID, messageID); !ok {
+		return
+	}
+	reactions, err := rt.db.GetReactions(ctx.Context, messageID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch reactions")
+		return
+	}
+	if reactions == nil {
+		reactions = []database.Reaction{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reactions); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode reactions")
+	}
+}
+
+// toggleReaction adds the caller's reaction with the given emoji, or removes
+// it if it is already there, and returns the updated reactions.
+func (rt *_router) toggleReaction(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	var req ReactionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateEmoji(req.Emoji); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rt.requireReactableMessage(w, ctx, conversationID, messageID) {
+		return
+	}
+	added, err := rt.db.ToggleReaction(ctx.Context, messageID, ctx.UserID, req.Emoji)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to toggle reaction")
+		return
+	}
+	eventType := events.ReactionRemoved
+	if added {
+		eventType = events.ReactionAdded
+	}
+	rt.publishEvent(ctx, eventType, conversationID, ReactionEvent{
+		MessageID: messageID,
+		UserID:    ctx.UserID,
+		Emoji:     req.Emoji,
+	})
+	reactions, err := rt.db.GetReactions(ctx.Context, messageID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch reactions")
+		return
+	}
+	if reactions == nil {
+		reactions = []database.Reaction{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ToggleReactionResponse{
+		Reacted:   added,
+		Reactions: reactions,
+	}); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode reactions")
+	}
+}
+
+// commentMessage adds a reaction; the emoji defaults to a heart so clients
+// written before reactions carried an emoji keep working.
+func (rt *_router) commentMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	var req ReactionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Emoji == "" {
+		req.Emoji = defaultReaction
+	}
+	if err := validateEmoji(req.Emoji); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !rt.requireReactableMessage(w, ctx, conversationID, messageID) {
+		return
+	}
+	if err := rt.db.AddReaction(ctx.Context, messageID, ctx.UserID, req.Emoji); err != nil {
+		rt.internalError(w, ctx, err, "Failed to add reaction")
+		return
+	}
+	rt.publishEvent(ctx, events.ReactionAdded, conversationID, ReactionEvent{
+		MessageID: messageID,
+		UserID:    ctx.UserID,
+		Emoji:     req.Emoji,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) uncommentMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	emoji := r.URL.Query().Get("emoji")
+	if emoji == "" {
+		emoji = defaultReaction
+	}
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if _, ok := rt.getConversationMessage(w, ctx, conversationID, messageID); !ok {
+		return
+	}
+	if err := rt.db.RemoveReaction(ctx.Context, messageID, ctx.UserID, emoji); err != nil {
+		rt.internalError(w, ctx, err, "Failed to remove reaction")
+		return
+	}
+	rt.publishEvent(ctx, events.ReactionRemoved, conversationID, ReactionEvent{
+		MessageID: messageID,
+		UserID:    ctx.UserID,
+		Emoji:     emoji,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rt *_router) requireReactableMessage(
+	w http.ResponseWriter,
+	ctx reqcontext.RequestContext,
+	conversationID string,
+	messageID string,
+) bool {
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return false
+	}
+	message, ok := rt.getConversationMessage(w, ctx, conversationID, messageID)
+	if !ok {
+		return false
+	}
+	if message.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be reacted to", http.StatusBadRequest)
+		return false
+	}
+	if message.Deleted {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// validateEmoji accepts a short sequence that contains at least one
+// non-ASCII symbol and no letters, spaces or control characters; this admits
+// keycaps, flags, skin tones and ZWJ sequences without a full emoji table.
+func validateEmoji(emoji string) error {
+	if emoji == "" {
+		return errors.New("Missing emoji")
+	}
+	if !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return errors.New("Invalid emoji")
+	}
+	symbol := false
+	for _, c := range emoji {
+		if unicode.IsSpace(c) || unicode.IsControl(c) || unicode.IsLetter(c) {
+			return errors.New("Invalid emoji")
+		}
+		if c > unicode.MaxASCII {
+			symbol = true
+		}
+	}
+	if !symbol {
+		return errors.New("Invalid emoji")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+	"github.com/tassdam/wasa/service/events"
+)
+
+func (rt *_router) getMessageReceipts(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if _, ok := rt.getConversationMessage(w, ctx, conversationID, messageID); !ok {
+		return
+	}
+	receipts, err := rt.db.GetMessageReceipts(ctx.Context, messageID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch receipts")
+		return
+	}
+	if receipts == nil {
+		receipts = []database.Receipt{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(MessageReceipts{
+		MessageID: messageID,
+		Receipts:  receipts,
+	}); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode receipts")
+	}
+}
+
+// markConversationRead marks the caller's messages in the conversation as
+// read, up to the requested message or all of them, and returns what is
+// left unread overall.
+func (rt *_router) markConversationRead(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	var req MarkReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	marked, err := rt.db.MarkMessagesAsRead(ctx.Context, conversationID, ctx.UserID, req.UpToMessageID)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to mark messages as read")
+		return
+	}
+	if marked > 0 {
+		rt.publishEvent(ctx, events.MessagesRead, conversationID, ReadEvent{
+			UserID:        ctx.UserID,
+			UpToMessageID: req.UpToMessageID,
+		})
+	}
+	rt.writeUnreadTotal(w, ctx)
+}
+
+func (rt *_router) getUnreadTotal(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	rt.writeUnreadTotal(w, ctx)
+}
+
+func (rt *_router) writeUnreadTotal(w http.ResponseWriter, ctx reqcontext.RequestContext) {
+	total, err := rt.db.GetUnreadTotal(ctx.Context, ctx.UserID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to count unread messages")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(total); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode unread count")
+	}
+}
+
+// markPushedDelivered records delivery of a message written to the
+// caller's event stream.
+func (rt *_router) markPushedDelivered(ctx reqcontext.RequestContext, event events.Event) {
+	if event.Type != events.MessageCreated {
+		return
+	}
+	message, ok := event.Payload.(database.Message)
+	if !ok || message.SenderId == ctx.UserID {
+		return
+	}
+	delivered, err := rt.db.MarkMessageAsDelivered(ctx.Context, message.Id, ctx.UserID)
+	if err != nil {
+		ctx.Logger.WithError(err).Error("Failed to mark message as delivered")
+		return
+	}
+	if delivered {
+		rt.publishEvent(ctx, events.MessagesDelivered, event.ConversationId, DeliveryEvent{
+			UserID:    ctx.UserID,
+			MessageID: message.Id,
+		})
+	}
+}
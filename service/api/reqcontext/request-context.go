@@ -1,11 +1,19 @@
 package reqcontext
 
 import (
+	"context"
+
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/tassdam/wasa/service/database"
 )
 
 type RequestContext struct {
 	ReqUUID uuid.UUID
 	Logger  logrus.FieldLogger
+	UserID  string
+	User    database.User
+	// Context ends when the client goes away or the server shuts down;
+	// it is passed to every database operation made for the request.
+	Context context.Context
 }
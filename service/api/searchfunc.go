@@ -0,0 +1,104 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+)
+
+func (rt *_router) searchMessages(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	search, err := parseMessageSearch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if search.ConversationId != "" && !rt.requireConversationMember(w, ctx, search.ConversationId) {
+		return
+	}
+	results, hasMore, err := rt.db.SearchMessages(ctx.Context, ctx.UserID, search)
+	if errors.Is(err, database.ErrInvalidSearchQuery) {
+		http.Error(w, "Search query has no terms", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Cursor message not found", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		rt.internalError(w, ctx, err, "Failed to search messages")
+		return
+	}
+	if results == nil {
+		results = []database.MessageSearchResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(MessageSearchPage{
+		Results: results,
+		HasMore: hasMore,
+	}); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode search results")
+	}
+}
+
+func parseMessageSearch(r *http.Request) (database.MessageSearch, error) {
+	query := r.URL.Query()
+	search := database.MessageSearch{
+		Query:          query.Get("q"),
+		ConversationId: query.Get("conversationId"),
+		SenderId:       query.Get("senderId"),
+		Before:         query.Get("before"),
+		Limit:          defaultSearchPageSize,
+	}
+	if search.Query == "" {
+		return search, errors.New("Missing 'q' query parameter")
+	}
+	var err error
+	if search.From, err = parseSearchTime(query.Get("from"), false); err != nil {
+		return search, errors.New("Invalid 'from', expected a date or an RFC 3339 timestamp")
+	}
+	if search.To, err = parseSearchTime(query.Get("to"), true); err != nil {
+		return search, errors.New("Invalid 'to', expected a date or an RFC 3339 timestamp")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxSearchPageSize {
+			return search, fmt.Errorf("limit must be between 1 and %d", maxSearchPageSize)
+		}
+		search.Limit = n
+	}
+	return search, nil
+}
+
+// parseSearchTime accepts an RFC 3339 timestamp or a UTC date; a date used
+// as an upper bound includes the whole day.
+func parseSearchTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
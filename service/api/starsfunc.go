@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/tassdam/wasa/service/api/reqcontext"
+	"github.com/tassdam/wasa/service/database"
+)
+
+func (rt *_router) starMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	message, ok := rt.getConversationMessage(w, ctx, conversationID, messageID)
+	if !ok {
+		return
+	}
+	if message.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be starred", http.StatusBadRequest)
+		return
+	}
+	if message.Deleted {
+		http.Error(w, "Message has been deleted", http.StatusBadRequest)
+		return
+	}
+	if err := rt.db.StarMessage(ctx.Context, messageID, ctx.UserID); err != nil {
+		rt.internalError(w, ctx, err, "Failed to star message")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) unstarMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	conversationID := ps.ByName("conversationId")
+	messageID := ps.ByName("messageId")
+	if !rt.requireConversationMember(w, ctx, conversationID) {
+		return
+	}
+	if _, ok := rt.getConversationMessage(w, ctx, conversationID, messageID); !ok {
+		return
+	}
+	if err := rt.db.UnstarMessage(ctx.Context, messageID, ctx.UserID); err != nil {
+		rt.internalError(w, ctx, err, "Failed to unstar message")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rt *_router) getStarredMessages(
+	w http.ResponseWriter,
+	r *http.Request,
+	ps httprouter.Params,
+	ctx reqcontext.RequestContext,
+) {
+	starred, err := rt.db.GetStarredMessages(ctx.Context, ctx.UserID)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to fetch starred messages")
+		return
+	}
+	if starred == nil {
+		starred = []database.StarredMessage{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(starred); err != nil {
+		ctx.Logger.WithError(err).Error("Failed to encode starred messages")
+	}
+}
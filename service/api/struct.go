@@ -1,6 +1,10 @@
 package api
 
-import "time"
+import (
+	"time"
+
+	"github.com/tassdam/wasa/service/database"
+)
 
 type LoginRequest struct {
 	Name  string `json:"name"`
@@ -9,6 +13,8 @@ type LoginRequest struct {
 
 type LoginResponse struct {
 	Identifier string `json:"identifier"`
+	Token      string `json:"token"`
+	ExpiresAt  string `json:"expiresAt"`
 }
 
 type UpdateUserRequest struct {
@@ -19,10 +25,18 @@ type UpdateGroupRequest struct {
 	Name string `json:"groupName"`
 }
 
+type UpdateMemberRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"userId"`
+}
+
 type User struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Photo []byte `json:"photo"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	PhotoID string `json:"photoId,omitempty"`
 }
 
 type Message struct {
@@ -31,3 +45,110 @@ type Message struct {
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// ForwardMessageRequest names the target conversations. The single
+// TargetConversationID form is still accepted from older clients.
+type ForwardMessageRequest struct {
+	TargetConversationIDs []string `json:"targetConversationIds"`
+	TargetConversationID  string   `json:"targetConversationId"`
+}
+
+// MarkReadRequest names the last message read; without it the whole
+// conversation is marked read.
+type MarkReadRequest struct {
+	UpToMessageID string `json:"upToMessageId"`
+}
+
+type MessageEvent struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"userId,omitempty"`
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+type MessageEdits struct {
+	MessageID string                 `json:"messageId"`
+	Revisions []database.MessageEdit `json:"revisions"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+type ReactionEvent struct {
+	MessageID string `json:"messageId"`
+	UserID    string `json:"userId"`
+	Emoji     string `json:"emoji"`
+}
+
+type ToggleReactionResponse struct {
+	Reacted   bool                `json:"reacted"`
+	Reactions []database.Reaction `json:"reactions"`
+}
+
+type PinEvent struct {
+	MessageID      string                   `json:"messageId"`
+	UserID         string                   `json:"userId"`
+	PinnedMessages []database.PinnedMessage `json:"pinnedMessages"`
+}
+
+// ReadEvent carries UpToMessageID when only the messages up to it were
+// read and omits it when the whole conversation was.
+type ReadEvent struct {
+	UserID        string `json:"userId"`
+	UpToMessageID string `json:"upToMessageId,omitempty"`
+}
+
+// DeliveryEvent carries MessageID when a single pushed message was
+// delivered and omits it when the whole conversation was.
+type DeliveryEvent struct {
+	UserID    string `json:"userId"`
+	MessageID string `json:"messageId,omitempty"`
+}
+
+type MessageReceipts struct {
+	MessageID string             `json:"messageId"`
+	Receipts  []database.Receipt `json:"receipts"`
+}
+
+type GroupChange struct {
+	Change  string `json:"change"`
+	UserID  string `json:"userId,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Name    string `json:"name,omitempty"`
+	PhotoID string `json:"photoId,omitempty"`
+}
+
+type PresenceStatus struct {
+	UserID   string `json:"userId"`
+	Visible  bool   `json:"visible"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"lastSeen,omitempty"`
+}
+
+type UpdatePresenceVisibilityRequest struct {
+	Visible *bool `json:"visible"`
+}
+
+type TypingEvent struct {
+	UserID string `json:"userId"`
+	Typing bool   `json:"typing"`
+}
+
+type ConversationView struct {
+	database.Conversation
+	Typing   []string                  `json:"typing"`
+	Presence map[string]PresenceStatus `json:"presence"`
+}
+
+type MessagesPage struct {
+	Messages []database.Message `json:"messages"`
+	HasMore  bool               `json:"hasMore"`
+}
+
+type MessageSearchPage struct {
+	Results []database.MessageSearchResult `json:"results"`
+	HasMore bool                           `json:"hasMore"`
+}
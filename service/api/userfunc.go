@@ -1,7 +1,6 @@
 package api
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
@@ -24,11 +23,7 @@ func (rt *_router) setMyUserName(
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	userID := ctx.UserID
 	var req UpdateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -38,13 +33,12 @@ func (rt *_router) setMyUserName(
 		http.Error(w, "Invalid username length", http.StatusBadRequest)
 		return
 	}
-	updatedUser, dbErr := rt.db.UpdateUserName(userID, req.Name)
+	updatedUser, dbErr := rt.db.UpdateUserName(ctx.Context, userID, req.Name)
 	if errors.Is(dbErr, database.ErrUserDoesNotExist) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	} else if dbErr != nil {
-		ctx.Logger.WithError(dbErr).Error("failed to update username")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, dbErr, "failed to update username")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -64,12 +58,8 @@ func (rt *_router) setMyPhoto(
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	err = r.ParseMultipartForm(10 * 1024 * 1024)
+	userID := ctx.UserID
+	err := r.ParseMultipartForm(10 * 1024 * 1024)
 	if err != nil {
 		http.Error(w, "Failed to parse form. Ensure the file is below 10 MB.", http.StatusBadRequest)
 		return
@@ -94,17 +84,25 @@ func (rt *_router) setMyPhoto(
 		http.Error(w, "Invalid file type. Only JPEG and PNG are supported.", http.StatusUnsupportedMediaType)
 		return
 	}
-	err = rt.db.UpdateUserPhoto(userID, photoData)
+	photoID, err := rt.storeMedia(ctx, photoData, fileType)
+	if err != nil {
+		rt.internalError(w, ctx, err, "Failed to store user photo")
+		return
+	}
+	err = rt.db.UpdateUserPhoto(ctx.Context, userID, photoID)
+	if err != nil {
+		rt.discardMedia(ctx, photoID)
+	}
 	if errors.Is(err, database.ErrUserDoesNotExist) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to update user photo")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to update user photo")
 		return
 	}
 	response := map[string]string{
 		"message": "Photo updated successfully",
+		"photoId": photoID,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -113,16 +111,16 @@ func (rt *_router) setMyPhoto(
 	}
 }
 
-func (rt *_router) getAuthenticatedUserID(r *http.Request) (string, error) {
+func getBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) < 7 || authHeader[:7] != "Bearer " {
 		return "", ErrUnauthorized
 	}
-	userID := authHeader[7:]
-	if userID == "" {
+	token := authHeader[7:]
+	if token == "" {
 		return "", ErrUnauthorized
 	}
-	return userID, nil
+	return token, nil
 }
 
 func (rt *_router) searchUsers(
@@ -136,26 +134,23 @@ func (rt *_router) searchUsers(
 		http.Error(w, "Missing 'username' query parameter", http.StatusBadRequest)
 		return
 	}
-	users, err := rt.db.SearchUsersByName(query)
+	users, err := rt.db.SearchUsersByName(ctx.Context, query)
 	if err != nil {
-		ctx.Logger.WithError(err).Error("Failed to search users")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to search users")
 		return
 	}
 	if len(users) == 0 {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode([]User{}); err != nil {
-			ctx.Logger.WithError(err).Error("Failed to encode empty users array")
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			rt.internalError(w, ctx, err, "Failed to encode empty users array")
 		}
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(users); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to encode users response")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to encode users response")
 	}
 }
 
@@ -165,30 +160,24 @@ func (rt *_router) getMyPhoto(
 	ps httprouter.Params,
 	ctx reqcontext.RequestContext,
 ) {
-	userID, err := rt.getAuthenticatedUserID(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-	user, dbErr := rt.db.GetUsersPhoto(userID)
+	userID := ctx.UserID
+	user, dbErr := rt.db.GetUsersPhoto(ctx.Context, userID)
 	if errors.Is(dbErr, database.ErrUserDoesNotExist) {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	} else if dbErr != nil {
-		ctx.Logger.WithError(dbErr).Error("Failed to fetch user details")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, dbErr, "Failed to fetch user details")
 		return
 	}
 	response := map[string]interface{}{
-		"name":  user.Name,
-		"photo": nil,
+		"name":    user.Name,
+		"photoId": nil,
 	}
-	if user.Photo != nil {
-		response["photo"] = base64.StdEncoding.EncodeToString(user.Photo)
+	if user.PhotoId != "" {
+		response["photoId"] = user.PhotoId
 	}
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
-		ctx.Logger.WithError(err).Error("Failed to encode user response")
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		rt.internalError(w, ctx, err, "Failed to encode user response")
 	}
 }
@@ -0,0 +1,45 @@
+package blobstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	BackendSQLite = "sqlite"
+	BackendFS     = "fs"
+	BackendS3     = "s3"
+)
+
+var ErrBlobNotFound = errors.New("Blob does not exist")
+
+// BlobStore keeps binary content addressed by key. Callers use the hex
+// SHA-256 of the content as key, so Put is idempotent.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Config selects and configures a backend. The conf tags let commands
+// embed it directly in their own configuration structs.
+type Config struct {
+	Backend string `conf:"default:sqlite"`
+	Dir     string `conf:"default:/tmp/decaf-blobs"`
+	Bucket  S3Config
+}
+
+func New(cfg Config, db *sql.DB) (BlobStore, error) {
+	switch cfg.Backend {
+	case BackendSQLite, "":
+		return NewSQLite(db)
+	case BackendFS:
+		return NewFS(cfg.Dir)
+	case BackendS3:
+		return NewS3(cfg.Bucket)
+	default:
+		return nil, fmt.Errorf("unknown blob store backend %q", cfg.Backend)
+	}
+}
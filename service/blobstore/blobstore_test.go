@@ -0,0 +1,101 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	testKey  = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	testData = "test"
+)
+
+// testRoundTrip checks the behaviour every backend must share: stored
+// content reads back unchanged, Put is idempotent and Delete tolerates
+// missing keys.
+func testRoundTrip(t *testing.T, store BlobStore) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := store.Get(ctx, testKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("getting a missing blob returned %v, want ErrBlobNotFound", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Put(ctx, testKey, []byte(testData)); err != nil {
+			t.Fatalf("put %d: %v", i+1, err)
+		}
+	}
+	data, err := store.Get(ctx, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte(testData)) {
+		t.Errorf("got %q, want %q", data, testData)
+	}
+	if err := store.Delete(ctx, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, testKey); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("getting a deleted blob returned %v, want ErrBlobNotFound", err)
+	}
+	if err := store.Delete(ctx, testKey); err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+}
+
+func TestFSRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, store)
+
+	if err := store.Put(context.Background(), "../escape", []byte(testData)); err == nil {
+		t.Error("put accepted a key escaping the blob directory")
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("blob directory still holds %v", matches)
+	}
+}
+
+func TestSQLiteRoundTrip(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	// The table is normally created by the database migrations.
+	_, err = db.Exec(`CREATE TABLE blobs (key TEXT NOT NULL PRIMARY KEY, data BLOB NOT NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSQLite(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, store)
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, testKey, []byte(testData)); !errors.Is(err, context.Canceled) {
+		t.Errorf("put with a canceled context returned %v, want context.Canceled", err)
+	}
+}
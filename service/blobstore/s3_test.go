@@ -0,0 +1,143 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory bucket that rejects, and records, requests whose
+// SigV4 signature does not verify.
+type fakeS3 struct {
+	cfg      S3Config
+	mu       sync.Mutex
+	objects  map[string][]byte
+	rejected []string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if problem := f.verify(r, body); problem != "" {
+		f.rejected = append(f.rejected, r.Method+" "+r.URL.Path+": "+problem)
+		http.Error(w, problem, http.StatusForbidden)
+		return
+	}
+	prefix := "/" + f.cfg.Name + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verify recomputes the signature following the AWS SigV4 specification
+// and returns a description of the first mismatch.
+func (f *fakeS3) verify(r *http.Request, body []byte) string {
+	amzDate := r.Header.Get("x-amz-date")
+	when, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return "invalid x-amz-date " + amzDate
+	}
+	if d := time.Since(when); d < -time.Minute || d > time.Minute {
+		return "x-amz-date is not current: " + amzDate
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if got := r.Header.Get("x-amz-content-sha256"); got != payloadHash {
+		return "x-amz-content-sha256 is " + got + ", want " + payloadHash
+	}
+	date := amzDate[:8]
+	scope := date + "/" + f.cfg.Region + "/s3/aws4_request"
+	canonicalRequest := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" +
+		payloadHash
+	canonicalSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := []byte("AWS4" + f.cfg.SecretKey)
+	for _, part := range []string{date, f.cfg.Region, "s3", "aws4_request"} {
+		key = testHMAC(key, part)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=" + f.cfg.AccessKey + "/" + scope +
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date" +
+		", Signature=" + hex.EncodeToString(testHMAC(key, stringToSign))
+	if got := r.Header.Get("Authorization"); got != want {
+		return "Authorization is " + got + ", want " + want
+	}
+	return ""
+}
+
+func testHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	cfg := S3Config{
+		Name:      "media",
+		Region:    "eu-south-1",
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	bucket := &fakeS3{cfg: cfg, objects: map[string][]byte{}}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	cfg.Endpoint = server.URL + "/"
+	store, err := NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRoundTrip(t, store)
+	for _, problem := range bucket.rejected {
+		t.Error(problem)
+	}
+
+	cfg.SecretKey = "wrong"
+	store, err = NewS3(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(context.Background(), testKey); err == nil || errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("get with a bad signature returned %v, want an error", err)
+	}
+	if len(bucket.rejected) != 1 {
+		t.Errorf("bucket rejected %d requests, want the badly signed one", len(bucket.rejected))
+	}
+}
@@ -0,0 +1,49 @@
+package blobstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+type sqliteStore struct {
+	c *sql.DB
+}
+
+// NewSQLite keeps blobs in the blobs table of db, which the database
+// schema migrations create.
+func NewSQLite(db *sql.DB) (BlobStore, error) {
+	if db == nil {
+		return nil, errors.New("database is required when building the sqlite blob store")
+	}
+	return &sqliteStore{c: db}, nil
+}
+
+func (s *sqliteStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.c.ExecContext(ctx, `INSERT INTO blobs (key, data) VALUES (?, ?) ON CONFLICT (key) DO NOTHING`, key, data)
+	if err != nil {
+		return fmt.Errorf("error saving blob: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.c.QueryRowContext(ctx, `SELECT data FROM blobs WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching blob: %w", err)
+	}
+	return data, nil
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, key string) error {
+	_, err := s.c.ExecContext(ctx, `DELETE FROM blobs WHERE key = ?`, key)
+	if err != nil {
+		return fmt.Errorf("error deleting blob: %w", err)
+	}
+	return nil
+}
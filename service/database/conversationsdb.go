@@ -1,17 +1,22 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
-func (db *appdbimpl) GetDirectConversation(senderID, recipientID string) (string, error) {
+func (db *appdbimpl) GetDirectConversation(ctx context.Context, senderID, recipientID string) (_ string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	if senderID == recipientID {
+		return db.getSelfConversation(ctx, senderID)
+	}
 	var conversationID string
-	err := db.c.QueryRow(`
+	err = db.c.QueryRowContext(ctx, `
 		SELECT id
 		FROM conversations
 		WHERE type = 'direct'
@@ -30,57 +35,192 @@ func (db *appdbimpl) GetDirectConversation(senderID, recipientID string) (string
 	return conversationID, nil
 }
 
-func (db *appdbimpl) CreateDirectConversation(conversationID, senderID, recipientID string) error {
-	_, err := db.c.Exec(`
-		INSERT INTO conversations (id, name, type, created_at, conversationPhoto)
-		VALUES (?, '', 'direct', ?, '')
-	`, conversationID, time.Now().Format(time.RFC3339))
-	if err != nil {
-		return fmt.Errorf("error creating new conversation: %w", err)
+func (db *appdbimpl) getSelfConversation(ctx context.Context, userID string) (string, error) {
+	var conversationID string
+	err := db.c.QueryRowContext(ctx, `
+		SELECT c.id
+		FROM conversations c
+		JOIN conversation_members cm ON c.id = cm.conversationId
+		WHERE c.type = 'self' AND cm.userId = ?
+	`, userID).Scan(&conversationID)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	_, err = db.c.Exec(`
-		INSERT INTO conversation_members (conversationId, userId)
-		VALUES (?, ?), (?, ?)
-	`, conversationID, senderID,
-		conversationID, recipientID)
 	if err != nil {
-		return fmt.Errorf("error adding members to conversation_members: %w", err)
+		return "", fmt.Errorf("error checking saved messages conversation: %w", err)
 	}
-	return nil
+	return conversationID, nil
 }
 
-func (db *appdbimpl) SaveMessage(
-	conversationID, senderID, messageID, content string, attachment []byte, replyTo string,
-) (Message, error) {
-	var conversationExists bool
-	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM conversations WHERE id = ?)`, conversationID).Scan(&conversationExists)
-	if err != nil {
-		return Message{}, fmt.Errorf("error checking conversation existence: %w", err)
-	}
-	if !conversationExists {
-		return Message{}, ErrConversationDoesNotExist
+func (db *appdbimpl) CreateDirectConversation(ctx context.Context, conversationID, senderID, recipientID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	if senderID == recipientID {
+		return db.createSelfConversation(ctx, conversationID, senderID)
 	}
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO conversations (id, name, type, created_at)
+			VALUES (?, '', 'direct', ?)
+		`, conversationID, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("error creating new conversation: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO conversation_members (conversationId, userId)
+			VALUES (?, ?), (?, ?)
+		`, conversationID, senderID,
+			conversationID, recipientID)
+		if err != nil {
+			return fmt.Errorf("error adding members to conversation_members: %w", err)
+		}
+		return nil
+	})
+}
+
+func (db *appdbimpl) createSelfConversation(ctx context.Context, conversationID, userID string) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO conversations (id, name, type, created_at)
+			VALUES (?, ?, 'self', ?)
+		`, conversationID, SelfConversationName, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("error creating saved messages conversation: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO conversation_members (conversationId, userId)
+			VALUES (?, ?)
+		`, conversationID, userID)
+		if err != nil {
+			return fmt.Errorf("error adding member to conversation_members: %w", err)
+		}
+		return nil
+	})
+}
+
+// SaveMessage stores a new message together with a pending receipt for
+// every other member of the conversation.
+func (db *appdbimpl) SaveMessage(
+	ctx context.Context, conversationID, senderID, messageID, content string, attachmentID string, replyTo string,
+) (_ Message, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	timestamp := time.Now().Format(time.RFC3339)
-	_, err = db.c.Exec(`
-        INSERT INTO messages (id, conversationId, senderId, content, timestamp, attachment, replyTo)
-        VALUES (?, ?, ?, ?, ?, ?, ?)
-    `, messageID, conversationID, senderID, content, timestamp, attachment, replyTo)
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var conversationExists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM conversations WHERE id = ?)`, conversationID).Scan(&conversationExists)
+		if err != nil {
+			return fmt.Errorf("error checking conversation existence: %w", err)
+		}
+		if !conversationExists {
+			return ErrConversationDoesNotExist
+		}
+		var replyToID sql.NullString
+		if replyTo != "" {
+			var replyExists bool
+			err = tx.QueryRowContext(ctx, `
+				SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversationId = ? AND deletedAt IS NULL)
+			`, replyTo, conversationID).Scan(&replyExists)
+			if err != nil {
+				return fmt.Errorf("error checking reply target: %w", err)
+			}
+			if !replyExists {
+				return ErrInvalidReplyTarget
+			}
+			replyToID = sql.NullString{String: replyTo, Valid: true}
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO messages (id, conversationId, senderId, content, timestamp, attachmentId, replyTo, isReply)
+			VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)
+		`, messageID, conversationID, senderID, content, timestamp, attachmentID, replyToID, replyToID.Valid)
+		if err != nil {
+			return fmt.Errorf("error saving message: %w", err)
+		}
+		return createReceipts(ctx, tx, conversationID, messageID, senderID)
+	})
 	if err != nil {
-		return Message{}, fmt.Errorf("error saving message: %w", err)
+		return Message{}, err
 	}
 	return Message{
 		Id:             messageID,
 		ConversationId: conversationID,
 		SenderId:       senderID,
+		Type:           MessageTypeText,
 		Content:        content,
 		Timestamp:      timestamp,
-		Attachment:     attachment,
+		AttachmentId:   attachmentID,
 		ReplyTo:        replyTo,
 	}, nil
 }
 
-func (db *appdbimpl) GetConversationMembers(conversationID string) ([]string, error) {
-	rows, err := db.c.Query(`
+// ForwardMessage copies the content and attachment of the source message
+// into a new message in every target conversation, all in one transaction.
+// forwardedFromMessageId records the message that was copied, so a chain
+// of forwards can be followed back, while forwardedFromUserId always names
+// the author of the original.
+func (db *appdbimpl) ForwardMessage(ctx context.Context, senderID, sourceMessageID string, targets []ForwardTarget) (_ []Message, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	timestamp := time.Now().Format(time.RFC3339)
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		for _, target := range targets {
+			res, err := tx.ExecContext(ctx, `
+				INSERT INTO messages (
+					id, conversationId, senderId, content, timestamp, attachmentId,
+					forwardedFromMessageId, forwardedFromUserId, isForward
+				)
+				SELECT ?, ?, ?, content, ?, attachmentId,
+					id, CASE WHEN isForward THEN forwardedFromUserId ELSE senderId END, 1
+				FROM messages
+				WHERE id = ? AND type = ? AND deletedAt IS NULL
+			`, target.MessageId, target.ConversationId, senderID, timestamp, sourceMessageID, MessageTypeText)
+			if err != nil {
+				return fmt.Errorf("error forwarding message: %w", err)
+			}
+			if affected, err := res.RowsAffected(); err != nil {
+				return err
+			} else if affected == 0 {
+				return ErrMessageDoesNotExist
+			}
+			if err := createReceipts(ctx, tx, target.ConversationId, target.MessageId, senderID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	forwarded := make([]Message, 0, len(targets))
+	for _, target := range targets {
+		message, err := db.GetMessage(ctx, target.MessageId, senderID)
+		if err != nil {
+			return nil, err
+		}
+		forwarded = append(forwarded, message)
+	}
+	return forwarded, nil
+}
+
+// createReceipts records that a message is pending delivery to every
+// member of the conversation but its sender.
+func createReceipts(ctx context.Context, tx *sql.Tx, conversationID, messageID, senderID string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO read_receipts (messageId, userId)
+		SELECT ?, userId
+		FROM conversation_members
+		WHERE conversationId = ? AND userId != ?
+	`, messageID, conversationID, senderID)
+	if err != nil {
+		return fmt.Errorf("error inserting receipts: %w", err)
+	}
+	return nil
+}
+
+func (db *appdbimpl) GetConversationMembers(ctx context.Context, conversationID string) (_ []string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `
 		SELECT userId
 		FROM conversation_members
 		WHERE conversationId = ?
@@ -103,20 +243,11 @@ func (db *appdbimpl) GetConversationMembers(conversationID string) ([]string, er
 	return members, nil
 }
 
-func (db *appdbimpl) InsertDeliveryReceipt(messageID, userID, deliveredAt string) error {
-	_, err := db.c.Exec(`
-		INSERT INTO read_receipts (messageId, userId, deliveredAt)
-		VALUES (?, ?, ?)
-	`, messageID, userID, deliveredAt)
-	if err != nil {
-		return fmt.Errorf("error inserting delivery receipt: %w", err)
-	}
-	return nil
-}
-
-func (db *appdbimpl) IsUserInConversation(conversationID, userID string) (bool, error) {
+func (db *appdbimpl) IsUserInConversation(ctx context.Context, conversationID, userID string) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var exists bool
-	err := db.c.QueryRow(`
+	err = db.c.QueryRowContext(ctx, `
 		SELECT EXISTS(
 			SELECT 1
 			FROM conversation_members
@@ -129,11 +260,12 @@ func (db *appdbimpl) IsUserInConversation(conversationID, userID string) (bool,
 	return exists, nil
 }
 
-func (db *appdbimpl) GetConversationDetails(conversationID, currentUserID string) (Conversation, error) {
+func (db *appdbimpl) GetConversationDetails(ctx context.Context, conversationID, currentUserID string, page MessagePage) (_ Conversation, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var conversation Conversation
-	var photoData []byte
-	err := db.c.QueryRow(`
-		SELECT id, name, type, created_at, conversationPhoto
+	err = db.c.QueryRowContext(ctx, `
+		SELECT id, name, type, created_at, IFNULL(photoId, '')
 		FROM conversations
 		WHERE id = ?
 	`, conversationID).Scan(
@@ -141,7 +273,7 @@ func (db *appdbimpl) GetConversationDetails(conversationID, currentUserID string
 		&conversation.Name,
 		&conversation.Type,
 		&conversation.CreatedAt,
-		&photoData,
+		&conversation.ConversationPhotoId,
 	)
 	if errors.Is(err, sql.ErrNoRows) {
 		return Conversation{}, ErrConversationDoesNotExist
@@ -149,15 +281,7 @@ func (db *appdbimpl) GetConversationDetails(conversationID, currentUserID string
 	if err != nil {
 		return Conversation{}, fmt.Errorf("error fetching conversation details: %w", err)
 	}
-	if len(photoData) > 0 {
-		conversation.ConversationPhoto = sql.NullString{
-			String: base64.StdEncoding.EncodeToString(photoData),
-			Valid:  true,
-		}
-	} else {
-		conversation.ConversationPhoto = sql.NullString{Valid: false}
-	}
-	members, err := db.GetConversationMembers(conversationID)
+	members, err := db.GetConversationMembers(ctx, conversationID)
 	if err != nil {
 		return Conversation{}, fmt.Errorf("error fetching conversation members: %w", err)
 	}
@@ -171,147 +295,231 @@ func (db *appdbimpl) GetConversationDetails(conversationID, currentUserID string
 			}
 		}
 		if otherUserID != "" {
-			var userPhotoData []byte
-			err := db.c.QueryRow("SELECT photo FROM users WHERE id = ?", otherUserID).Scan(&userPhotoData)
-			if err == nil && len(userPhotoData) > 0 {
-				conversation.ConversationPhoto = sql.NullString{
-					String: base64.StdEncoding.EncodeToString(userPhotoData),
-					Valid:  true,
-				}
+			var userPhotoID string
+			err := db.c.QueryRowContext(ctx, "SELECT IFNULL(photoId, '') FROM users WHERE id = ?", otherUserID).Scan(&userPhotoID)
+			if err == nil && userPhotoID != "" {
+				conversation.ConversationPhotoId = userPhotoID
 			}
 		}
 	}
-	messages, err := db.GetMessagesForConversation(conversationID)
+	messages, hasMore, err := db.GetMessagesForConversation(ctx, conversationID, currentUserID, page)
 	if err != nil {
 		return Conversation{}, fmt.Errorf("error fetching conversation messages: %w", err)
 	}
 	conversation.Messages = messages
+	conversation.HasMoreMessages = hasMore
+	pins, err := db.GetPinnedMessages(ctx, conversationID)
+	if err != nil {
+		return Conversation{}, err
+	}
+	conversation.PinnedMessages = pins
 	return conversation, nil
 }
 
-func (db *appdbimpl) GetMessagesForConversation(conversationID string) ([]Message, error) {
+// GetMessagesForConversation returns a page of the messages visible to the
+// user; messages deleted for everyone are returned as tombstones.
+func (db *appdbimpl) GetMessagesForConversation(ctx context.Context, conversationID, userID string, page MessagePage) (_ []Message, _ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	cursorID := page.Before
+	cursorOp, order := "<", "DESC"
+	if page.After != "" {
+		cursorID = page.After
+		cursorOp, order = ">", "ASC"
+	}
+	cursorFilter := ""
+	args := []interface{}{userID, conversationID, userID}
+	if cursorID != "" {
+		var cursorTimestamp string
+		var cursorRowID int64
+		err := db.c.QueryRowContext(ctx, `
+			SELECT timestamp, rowid FROM messages WHERE id = ? AND conversationId = ?
+		`, cursorID, conversationID).Scan(&cursorTimestamp, &cursorRowID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, ErrMessageDoesNotExist
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("error fetching message cursor: %w", err)
+		}
+		cursorFilter = "AND (m.timestamp, m.rowid) " + cursorOp + " (?, ?)"
+		args = append(args, cursorTimestamp, cursorRowID)
+	}
+	args = append(args, page.Limit+1)
 	query := `
-SELECT 
+SELECT ` + messageColumns + `
+FROM messages m ` + messageJoins + `
+WHERE m.conversationId = ?
+  AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.messageId = m.id AND h.userId = ?)
+  ` + cursorFilter + `
+ORDER BY m.timestamp ` + order + `, m.rowid ` + order + `
+LIMIT ?;
+`
+	rows, err := db.c.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("error fetching messages: %w", err)
+	}
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("error iterating message rows: %w", err)
+	}
+	hasMore := len(messages) > page.Limit
+	if hasMore {
+		messages = messages[:page.Limit]
+	}
+	if order == "DESC" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	if err := db.loadReactions(ctx, messages); err != nil {
+		return nil, false, err
+	}
+	return messages, hasMore, nil
+}
+
+// messageColumns and messageJoins select a message from "messages m" as
+// read by scanMessage. The single placeholder is the viewing user's id.
+const messageColumns = `
     m.id, 
     m.conversationId, 
     m.senderId, 
+    m.type,
     m.content, 
     m.timestamp, 
-    m.attachment,
-    m.replyTo,
+    IFNULL(m.attachmentId, '') AS attachmentId,
+    IFNULL(m.replyTo, '') AS replyTo,
+    m.isReply,
+    IFNULL(m.editedAt, '') AS editedAt,
+    IFNULL(m.deletedAt, '') AS deletedAt,
     u.name AS senderName,
-    u.photo AS senderPhoto,
+    IFNULL(u.photoId, '') AS senderPhotoId,
     ((SELECT COUNT(*) FROM conversation_members WHERE conversationId = m.conversationId) - 1) AS totalRecipients,
     (SELECT COUNT(*) FROM read_receipts WHERE messageId = m.id AND readAt IS NOT NULL) AS readCount,
-    COUNT(c.id) AS reaction_count,
-    GROUP_CONCAT(DISTINCT u2.name) AS reacting_user_names,
     IFNULL(r.content, '') AS replyContent,
     IFNULL(ru.name, '') AS replySenderName,
-    r.attachment AS replyAttachment
-FROM messages m
+    IFNULL(r.attachmentId, '') AS replyAttachmentId,
+    r.deletedAt IS NOT NULL AS replyTombstone,
+    m.isForward,
+    IFNULL(m.forwardedFromMessageId, '') AS forwardedFromMessageId,
+    IFNULL(m.forwardedFromUserId, '') AS forwardedFromUserId,
+    IFNULL(fu.name, '') AS forwardedFromName,
+    EXISTS (SELECT 1 FROM starred_messages s WHERE s.messageId = m.id AND s.userId = ?) AS starred`
+
+const messageJoins = `
 JOIN users u ON m.senderId = u.id
-LEFT JOIN comments c ON m.id = c.messageId
-LEFT JOIN users u2 ON c.authorId = u2.id
-LEFT JOIN messages r ON m.replyTo = r.id
+LEFT JOIN messages r ON m.replyTo = r.id AND r.conversationId = m.conversationId
 LEFT JOIN users ru ON r.senderId = ru.id
-WHERE m.conversationId = ?
-GROUP BY m.id
-ORDER BY m.timestamp ASC;
-`
-	rows, err := db.c.Query(query, conversationID)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching messages: %w", err)
+LEFT JOIN users fu ON m.forwardedFromUserId = fu.id`
+
+// scanMessage reads a row selected with messageColumns, followed by any
+// extra columns.
+func scanMessage(rows *sql.Rows, extra ...interface{}) (Message, error) {
+	var msg Message
+	var totalRecipients, readCount int
+	var isReply, replyTombstone bool
+	var deletedAt string
+	dest := []interface{}{
+		&msg.Id,
+		&msg.ConversationId,
+		&msg.SenderId,
+		&msg.Type,
+		&msg.Content,
+		&msg.Timestamp,
+		&msg.AttachmentId,
+		&msg.ReplyTo,
+		&isReply,
+		&msg.EditedAt,
+		&deletedAt,
+		&msg.SenderName,
+		&msg.SenderPhotoId,
+		&totalRecipients,
+		&readCount,
+		&msg.ReplyContent,
+		&msg.ReplySenderName,
+		&msg.ReplyAttachmentId,
+		&replyTombstone,
+		&msg.Forwarded,
+		&msg.ForwardedFromMessageId,
+		&msg.ForwardedFromUserId,
+		&msg.ForwardedFromName,
+		&msg.Starred,
 	}
-	defer rows.Close()
-	var messages []Message
-	for rows.Next() {
-		var msg Message
-		var senderPhoto []byte
-		var totalRecipients, readCount, reactionCount int
-		var reactingUserNames sql.NullString
-		err := rows.Scan(
-			&msg.Id,
-			&msg.ConversationId,
-			&msg.SenderId,
-			&msg.Content,
-			&msg.Timestamp,
-			&msg.Attachment,
-			&msg.ReplyTo,
-			&msg.SenderName,
-			&senderPhoto,
-			&totalRecipients,
-			&readCount,
-			&reactionCount,
-			&reactingUserNames,
-			&msg.ReplyContent,
-			&msg.ReplySenderName,
-			&msg.ReplyAttachment,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("error scanning message row: %w", err)
-		}
-		if senderPhoto != nil {
-			msg.SenderPhoto = base64.StdEncoding.EncodeToString(senderPhoto)
-		}
-		msg.ReactionCount = reactionCount
-		if reactingUserNames.Valid && reactingUserNames.String != "" {
-			msg.ReactingUserNames = strings.Split(reactingUserNames.String, ",")
-		} else {
-			msg.ReactingUserNames = []string{}
-		}
-		if totalRecipients > 0 && readCount >= totalRecipients {
-			msg.Status = "✓✓"
-		} else {
-			msg.Status = "✓"
-		}
-		messages = append(messages, msg)
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return Message{}, fmt.Errorf("error scanning message row: %w", err)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating message rows: %w", err)
+	msg.ReplyDeleted = isReply && msg.ReplyTo == "" || replyTombstone
+	msg.Edited = msg.EditedAt != ""
+	if deletedAt != "" {
+		msg.Deleted = true
+		msg.Content = DeletedMessageContent
 	}
-	return messages, nil
+	if totalRecipients > 0 && readCount >= totalRecipients {
+		msg.Status = "✓✓"
+	} else {
+		msg.Status = "✓"
+	}
+	return msg, nil
 }
 
-func (db *appdbimpl) GetMyConversations(userID string) ([]Conversation, error) {
+// loadReactions fills in the reactions of the messages.
+func (db *appdbimpl) loadReactions(ctx context.Context, messages []Message) error {
+	messageIDs := make([]string, len(messages))
+	for i, msg := range messages {
+		messageIDs[i] = msg.Id
+	}
+	reactions, err := db.getReactions(ctx, messageIDs)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].Id]
+	}
+	return nil
+}
+
+// GetMyConversations lists the user's conversations, most recently active
+// first, with their last visible message, members and unread count. It
+// runs a fixed number of queries however many conversations there are.
+func (db *appdbimpl) GetMyConversations(ctx context.Context, userID string) (_ []Conversation, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	query := `
-	SELECT 
+	SELECT
 		c.id,
-		CASE 
-			WHEN c.type = 'direct' THEN 
-				(SELECT u.name 
-				FROM users u 
-				JOIN conversation_members cm2 
-				ON u.id = cm2.userId 
-				WHERE cm2.conversationId = c.id AND u.id != ?)
-			ELSE c.name
-		END AS conversation_name,
+		CASE WHEN c.type = 'direct' THEN IFNULL(pu.name, '') ELSE c.name END AS conversation_name,
 		c.type,
 		c.created_at,
-		CASE 
-			WHEN c.type = 'direct' THEN 
-				(SELECT u.photo 
-				FROM users u 
-				JOIN conversation_members cm2 
-				ON u.id = cm2.userId 
-				WHERE cm2.conversationId = c.id AND u.id != ?)
-			ELSE c.conversationPhoto
-		END AS conversation_photo,
-		(SELECT m.id FROM messages m WHERE m.conversationId = c.id ORDER BY m.timestamp DESC LIMIT 1) AS last_message_id,
-		(SELECT m.content FROM messages m WHERE m.conversationId = c.id ORDER BY m.timestamp DESC LIMIT 1) AS last_message_content,
-		(SELECT m.timestamp FROM messages m WHERE m.conversationId = c.id ORDER BY m.timestamp DESC LIMIT 1) AS last_message_timestamp,
-		(SELECT u.name FROM messages m 
-		JOIN users u ON m.senderId = u.id 
-		WHERE m.conversationId = c.id 
-		ORDER BY m.timestamp DESC LIMIT 1) AS last_message_sender_name,
-		(SELECT m.attachment FROM messages m   -- Fetch actual attachment data
-		WHERE m.conversationId = c.id 
-		ORDER BY m.timestamp DESC LIMIT 1) AS last_message_attachment
-	FROM conversations c
-	JOIN conversation_members cm ON c.id = cm.conversationId
+		CASE WHEN c.type = 'direct' THEN pu.photoId ELSE c.photoId END AS conversation_photo_id,
+		lm.id AS last_message_id,
+		lm.content AS last_message_content,
+		lm.timestamp AS last_message_timestamp,
+		lu.name AS last_message_sender_name,
+		lm.attachmentId AS last_message_attachment_id,
+		lm.deletedAt IS NOT NULL AS last_message_deleted,
+		IFNULL(lm.isForward, 0) AS last_message_forwarded
+	FROM conversation_members cm
+	JOIN conversations c ON c.id = cm.conversationId
+	LEFT JOIN conversation_members peer
+		ON c.type = 'direct' AND peer.conversationId = c.id AND peer.userId != cm.userId
+	LEFT JOIN users pu ON pu.id = peer.userId
+	LEFT JOIN messages lm ON lm.id = (
+		SELECT m.id FROM messages m
+		WHERE m.conversationId = c.id
+		  AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.messageId = m.id AND h.userId = cm.userId)
+		ORDER BY m.timestamp DESC, m.rowid DESC LIMIT 1)
+	LEFT JOIN users lu ON lm.senderId = lu.id
 	WHERE cm.userId = ?
 	ORDER BY last_message_timestamp DESC NULLS LAST;
     `
-	rows, err := db.c.Query(query, userID, userID, userID)
+	rows, err := db.c.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching conversations: %w", err)
 	}
@@ -324,7 +532,9 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]Conversation, error) {
 			lastMessageContent    sql.NullString
 			lastMessageTimestamp  sql.NullString
 			lastMessageSender     sql.NullString
-			lastMessageAttachment []byte
+			lastMessageAttachment sql.NullString
+			lastMessageDeleted    bool
+			lastMessageForwarded  bool
 			convPhoto             sql.NullString
 		)
 		err := rows.Scan(
@@ -338,88 +548,280 @@ func (db *appdbimpl) GetMyConversations(userID string) ([]Conversation, error) {
 			&lastMessageTimestamp,
 			&lastMessageSender,
 			&lastMessageAttachment,
+			&lastMessageDeleted,
+			&lastMessageForwarded,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning conversation: %w", err)
 		}
-		if convPhoto.Valid {
-			conv.ConversationPhoto.String = base64.StdEncoding.EncodeToString([]byte(convPhoto.String))
-			conv.ConversationPhoto.Valid = true
-		}
+		conv.ConversationPhotoId = convPhoto.String
 		if lastMessageID.Valid {
 			conv.LastMessage = &Message{
-				Id:         lastMessageID.String,
-				Content:    lastMessageContent.String,
-				Timestamp:  lastMessageTimestamp.String,
-				SenderName: lastMessageSender.String,
-				Attachment: lastMessageAttachment,
+				Id:           lastMessageID.String,
+				Content:      lastMessageContent.String,
+				Timestamp:    lastMessageTimestamp.String,
+				SenderName:   lastMessageSender.String,
+				AttachmentId: lastMessageAttachment.String,
+				Forwarded:    lastMessageForwarded,
+			}
+			if lastMessageDeleted {
+				conv.LastMessage.Deleted = true
+				conv.LastMessage.Content = DeletedMessageContent
 			}
 		}
-		members, err := db.GetConversationMembers(conv.Id)
-		if err != nil {
-			return nil, fmt.Errorf("error fetching conversation members: %w", err)
-		}
-		conv.Members = members
 		conversations = append(conversations, conv)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating over rows: %w", err)
 	}
+	members, err := db.membersOfUserConversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := db.unreadStates(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range conversations {
+		conversations[i].Members = members[conversations[i].Id]
+		state := unread[conversations[i].Id]
+		conversations[i].UnreadCount = state.count
+		conversations[i].FirstUnreadMessageId = state.firstID
+	}
 	return conversations, nil
 }
 
-func (db *appdbimpl) DeleteMessage(conversationID, messageID, userID string) error {
-	var senderID string
-	err := db.c.QueryRow(`
-		SELECT senderId
-		FROM messages
-		WHERE conversationId = ? AND id = ?
-	`, conversationID, messageID).Scan(&senderID)
-	if errors.Is(err, sql.ErrNoRows) {
-		return ErrMessageDoesNotExist
+// membersOfUserConversations returns the members of every conversation
+// the user belongs to, keyed by conversation.
+func (db *appdbimpl) membersOfUserConversations(ctx context.Context, userID string) (map[string][]string, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT cm.conversationId, cm.userId
+		FROM conversation_members mine
+		JOIN conversation_members cm ON cm.conversationId = mine.conversationId
+		WHERE mine.userId = ?
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching conversation members: %w", err)
+	}
+	defer rows.Close()
+	members := map[string][]string{}
+	for rows.Next() {
+		var conversationID, memberID string
+		if err := rows.Scan(&conversationID, &memberID); err != nil {
+			return nil, err
+		}
+		members[conversationID] = append(members[conversationID], memberID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating members: %w", err)
 	}
+	return members, nil
+}
+
+// unreadMessages selects the messages the user has not read yet. Deleted
+// and hidden messages are left out, as are conversations the user has left.
+// Its single placeholder is the user.
+const unreadMessages = `
+	FROM read_receipts r
+	JOIN messages m ON m.id = r.messageId
+	JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId = r.userId
+	WHERE r.userId = ? AND r.readAt IS NULL AND m.deletedAt IS NULL
+	  AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.messageId = m.id AND h.userId = r.userId)
+`
+
+type unreadState struct {
+	count   int
+	firstID string
+}
+
+// unreadStates returns, per conversation, how many messages the user has
+// not read yet and the oldest of them.
+func (db *appdbimpl) unreadStates(ctx context.Context, userID string) (map[string]unreadState, error) {
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT conversationId, id, unread
+		FROM (
+			SELECT m.conversationId, m.id,
+				COUNT(*) OVER (PARTITION BY m.conversationId) AS unread,
+				ROW_NUMBER() OVER (PARTITION BY m.conversationId ORDER BY m.timestamp, m.rowid) AS position
+			`+unreadMessages+`
+		)
+		WHERE position = 1
+	`, userID)
 	if err != nil {
-		return fmt.Errorf("error fetching message: %w", err)
+		return nil, fmt.Errorf("error counting unread messages: %w", err)
+	}
+	defer rows.Close()
+	states := map[string]unreadState{}
+	for rows.Next() {
+		var conversationID string
+		var state unreadState
+		if err := rows.Scan(&conversationID, &state.firstID, &state.count); err != nil {
+			return nil, err
+		}
+		states[conversationID] = state
 	}
-	if senderID != userID {
-		return ErrUnauthorizedToDeleteMessage
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating unread counts: %w", err)
 	}
-	_, err = db.c.Exec(`
-		DELETE FROM messages
-		WHERE conversationId = ? AND id = ?
-	`, conversationID, messageID)
+	return states, nil
+}
+
+// GetUnreadTotal counts the user's unread messages across conversations.
+func (db *appdbimpl) GetUnreadTotal(ctx context.Context, userID string) (_ UnreadTotal, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var total UnreadTotal
+	err = db.c.QueryRowContext(ctx, `
+		SELECT COUNT(*), COUNT(DISTINCT m.conversationId)
+	`+unreadMessages, userID).Scan(&total.Messages, &total.Conversations)
 	if err != nil {
-		return fmt.Errorf("error deleting message: %w", err)
+		return UnreadTotal{}, fmt.Errorf("error counting unread messages: %w", err)
 	}
-	return nil
+	return total, nil
 }
 
-func (db *appdbimpl) GetMessage(messageID, userID string) (Message, error) {
+// DeleteMessage deletes a message for everyone. The row is kept as a
+// tombstone so replies and the conversation flow stay intact, while its
+// content, attachment, reactions and edit history are removed.
+func (db *appdbimpl) DeleteMessage(ctx context.Context, conversationID, messageID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var attachmentID string
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var senderID string
+		var deleted bool
+		err := tx.QueryRowContext(ctx, `
+			SELECT senderId, IFNULL(attachmentId, ''), deletedAt IS NOT NULL
+			FROM messages
+			WHERE conversationId = ? AND id = ?
+		`, conversationID, messageID).Scan(&senderID, &attachmentID, &deleted)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching message: %w", err)
+		}
+		if senderID != userID {
+			return ErrUnauthorizedToDeleteMessage
+		}
+		if deleted {
+			attachmentID = ""
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE messages
+			SET content = '', attachmentId = NULL, deletedAt = ?
+			WHERE id = ?
+		`, time.Now().Format(time.RFC3339), messageID)
+		if err != nil {
+			return fmt.Errorf("error deleting message: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM reactions WHERE messageId = ?`, messageID); err != nil {
+			return fmt.Errorf("error deleting message reactions: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_edits WHERE messageId = ?`, messageID); err != nil {
+			return fmt.Errorf("error deleting message revisions: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM pinned_messages WHERE messageId = ?`, messageID); err != nil {
+			return fmt.Errorf("error unpinning message: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM starred_messages WHERE messageId = ?`, messageID); err != nil {
+			return fmt.Errorf("error unstarring message: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The blob store may write through another connection, so unused media
+	// is only removed once the deletion is committed.
+	return db.deleteMediaIfUnused(ctx, attachmentID)
+}
+
+// HideMessage deletes a message for the user only.
+func (db *appdbimpl) HideMessage(ctx context.Context, conversationID, messageID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO hidden_messages (messageId, userId, hiddenAt)
+			SELECT id, ?, ? FROM messages WHERE id = ? AND conversationId = ?
+			ON CONFLICT (userId, messageId) DO NOTHING
+		`, userID, time.Now().Format(time.RFC3339), messageID, conversationID)
+		if err != nil {
+			return fmt.Errorf("error hiding message: %w", err)
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			var exists bool
+			err := tx.QueryRowContext(ctx, `
+				SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversationId = ?)
+			`, messageID, conversationID).Scan(&exists)
+			if err != nil {
+				return fmt.Errorf("error checking message existence: %w", err)
+			}
+			if !exists {
+				return ErrMessageDoesNotExist
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM starred_messages WHERE messageId = ? AND userId = ?
+		`, messageID, userID)
+		if err != nil {
+			return fmt.Errorf("error unstarring message: %w", err)
+		}
+		return nil
+	})
+}
+
+// GetMessage returns a message of a conversation the user belongs to. A
+// message the user has hidden does not exist for them, as in listings.
+func (db *appdbimpl) GetMessage(ctx context.Context, messageID, userID string) (_ Message, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var message Message
-	err := db.c.QueryRow(`
+	err = db.c.QueryRowContext(ctx, `
         SELECT 
             m.id, 
             m.conversationId, 
             m.senderId, 
+            m.type,
             m.content, 
             m.timestamp, 
-            m.attachment,
+            IFNULL(m.attachmentId, ''),
+            IFNULL(m.editedAt, ''),
+            m.deletedAt IS NOT NULL,
+            m.isForward,
+            IFNULL(m.forwardedFromMessageId, ''),
+            IFNULL(m.forwardedFromUserId, ''),
+            IFNULL(fu.name, ''),
             u.name AS senderName
         FROM 
             messages m
         JOIN 
             users u ON m.senderId = u.id
+        LEFT JOIN
+            users fu ON m.forwardedFromUserId = fu.id
         JOIN 
             conversation_members cm ON m.conversationId = cm.conversationId
         WHERE 
             m.id = ? AND cm.userId = ?
+            AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.messageId = m.id AND h.userId = cm.userId)
     `, messageID, userID).Scan(
 		&message.Id,
 		&message.ConversationId,
 		&message.SenderId,
+		&message.Type,
 		&message.Content,
 		&message.Timestamp,
-		&message.Attachment,
+		&message.AttachmentId,
+		&message.EditedAt,
+		&message.Deleted,
+		&message.Forwarded,
+		&message.ForwardedFromMessageId,
+		&message.ForwardedFromUserId,
+		&message.ForwardedFromName,
 		&message.SenderName,
 	)
 	if err == sql.ErrNoRows {
@@ -428,16 +830,142 @@ func (db *appdbimpl) GetMessage(messageID, userID string) (Message, error) {
 	if err != nil {
 		return message, fmt.Errorf("error fetching message: %w", err)
 	}
+	message.Edited = message.EditedAt != ""
 	return message, nil
 }
 
-func (db *appdbimpl) MarkMessagesAsRead(conversationID, userID string) error {
-	_, err := db.c.Exec(`
+// MarkMessagesAsRead marks the user's messages in the conversation as read
+// up to and including upToMessageID, or all of them if it is empty. It
+// also stamps deliveredAt on messages that were never marked delivered.
+func (db *appdbimpl) MarkMessagesAsRead(ctx context.Context, conversationID, userID, upToMessageID string) (_ int64, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var marked int64
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		if upToMessageID != "" {
+			var exists bool
+			err := tx.QueryRowContext(ctx, `
+				SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND conversationId = ?)
+			`, upToMessageID, conversationID).Scan(&exists)
+			if err != nil {
+				return fmt.Errorf("error fetching message: %w", err)
+			}
+			if !exists {
+				return ErrMessageDoesNotExist
+			}
+		}
+		readAt := time.Now().Format(time.RFC3339)
+		res, err := tx.ExecContext(ctx, `
+			UPDATE read_receipts
+			SET readAt = ?, deliveredAt = COALESCE(deliveredAt, ?)
+			WHERE messageId IN (
+				SELECT m.id FROM messages m
+				WHERE m.conversationId = ?
+				  AND (? = '' OR (m.timestamp, m.rowid) <= (SELECT timestamp, rowid FROM messages WHERE id = ?))
+			)
+			  AND userId = ?
+			  AND readAt IS NULL
+		`, readAt, readAt, conversationID, upToMessageID, upToMessageID, userID)
+		if err != nil {
+			return fmt.Errorf("error marking messages as read: %w", err)
+		}
+		marked, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return marked, nil
+}
+
+// MarkListedMessagesAsDelivered marks the given messages as delivered to
+// the user and returns those that were still pending.
+func (db *appdbimpl) MarkListedMessagesAsDelivered(ctx context.Context, userID string, messageIDs []string) (_ []string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, 0, len(messageIDs)+1)
+	args = append(args, userID)
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+	pending := `userId = ? AND deliveredAt IS NULL AND messageId IN (?` + strings.Repeat(", ?", len(messageIDs)-1) + `)`
+	var delivered []string
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT messageId FROM read_receipts WHERE `+pending, args...)
+		if err != nil {
+			return fmt.Errorf("error fetching pending deliveries: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var messageID string
+			if err := rows.Scan(&messageID); err != nil {
+				return err
+			}
+			delivered = append(delivered, messageID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error iterating pending deliveries: %w", err)
+		}
+		if len(delivered) == 0 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE read_receipts SET deliveredAt = ? WHERE `+pending,
+			append([]interface{}{time.Now().Format(time.RFC3339)}, args...)...)
+		if err != nil {
+			return fmt.Errorf("error marking messages as delivered: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivered, nil
+}
+
+// MarkMessageAsDelivered reports whether the receipt was still pending.
+func (db *appdbimpl) MarkMessageAsDelivered(ctx context.Context, messageID, userID string) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	deliveredAt := time.Now().Format(time.RFC3339)
+	res, err := db.c.ExecContext(ctx, `
         UPDATE read_receipts
-        SET readAt = CURRENT_TIMESTAMP
-        WHERE messageId IN (SELECT id FROM messages WHERE conversationId = ?)
-          AND userId = ?
-          AND readAt IS NULL
-    `, conversationID, userID)
-	return err
+        SET deliveredAt = ?
+        WHERE messageId = ? AND userId = ? AND deliveredAt IS NULL
+    `, deliveredAt, messageID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error marking message as delivered: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (db *appdbimpl) GetMessageReceipts(ctx context.Context, messageID string) (_ []Receipt, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT r.userId, u.name, IFNULL(r.deliveredAt, ''), IFNULL(r.readAt, '')
+        FROM read_receipts r
+        JOIN users u ON r.userId = u.id
+        WHERE r.messageId = ?
+        ORDER BY u.name
+    `, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching receipts: %w", err)
+	}
+	defer rows.Close()
+	var receipts []Receipt
+	for rows.Next() {
+		var receipt Receipt
+		if err := rows.Scan(&receipt.UserId, &receipt.UserName, &receipt.DeliveredAt, &receipt.ReadAt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating receipts: %w", err)
+	}
+	return receipts, nil
 }
@@ -0,0 +1,441 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestGetMyConversations(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	if err := db.CreateDirectConversation(ctx, "direct", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateDirectConversation(ctx, "empty", alice, carol); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateGroupConversation(ctx, "group", alice, []string{bob, carol}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	send := func(conversationID, senderID, messageID string) {
+		t.Helper()
+		if _, err := db.SaveMessage(ctx, conversationID, senderID, messageID, "content of "+messageID, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("direct", bob, "d1")
+	send("direct", bob, "d2")
+	send("direct", bob, "d3")
+	if err := db.HideMessage(ctx, "direct", "d3", alice); err != nil {
+		t.Fatal(err)
+	}
+	send("group", alice, "g1")
+	send("group", carol, "g2")
+	send("group", bob, "g3")
+	if err := db.DeleteMessage(ctx, "group", "g3", bob); err != nil {
+		t.Fatal(err)
+	}
+
+	conversations := getConversationsByID(t, db, alice)
+	if len(conversations) != 3 {
+		t.Fatalf("got %d conversations, want 3", len(conversations))
+	}
+
+	direct := conversations["direct"]
+	if direct.Name != "bob" || direct.Type != "direct" {
+		t.Errorf("direct conversation is %q of type %q, want bob of type direct", direct.Name, direct.Type)
+	}
+	if direct.LastMessage == nil || direct.LastMessage.Id != "d2" || direct.LastMessage.SenderName != "bob" {
+		t.Errorf("direct conversation last message is %+v, want d2 by bob since d3 is hidden", direct.LastMessage)
+	}
+	if direct.UnreadCount != 2 || direct.FirstUnreadMessageId != "d1" {
+		t.Errorf("direct conversation has %d unread from %q, want 2 from d1", direct.UnreadCount, direct.FirstUnreadMessageId)
+	}
+	assertMembers(t, direct, alice, bob)
+
+	group := conversations["group"]
+	if group.Name != "friends" {
+		t.Errorf("group name is %q, want friends", group.Name)
+	}
+	if group.LastMessage == nil || group.LastMessage.Id != "g3" || !group.LastMessage.Deleted ||
+		group.LastMessage.Content != DeletedMessageContent {
+		t.Errorf("group last message is %+v, want the g3 tombstone", group.LastMessage)
+	}
+	if group.UnreadCount != 1 || group.FirstUnreadMessageId != "g2" {
+		t.Errorf("group has %d unread from %q, want 1 from g2", group.UnreadCount, group.FirstUnreadMessageId)
+	}
+	assertMembers(t, group, alice, bob, carol)
+
+	empty := conversations["empty"]
+	if empty.Name != "carol" || empty.LastMessage != nil || empty.UnreadCount != 0 || empty.FirstUnreadMessageId != "" {
+		t.Errorf("empty conversation is %+v, want carol with no messages", empty)
+	}
+
+	if _, err := db.MarkMessagesAsRead(ctx, "direct", alice, "d1"); err != nil {
+		t.Fatal(err)
+	}
+	direct = getConversationsByID(t, db, alice)["direct"]
+	if direct.UnreadCount != 1 || direct.FirstUnreadMessageId != "d2" {
+		t.Errorf("after reading d1 direct has %d unread from %q, want 1 from d2", direct.UnreadCount, direct.FirstUnreadMessageId)
+	}
+	total, err := db.GetUnreadTotal(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Messages != 2 || total.Conversations != 2 {
+		t.Errorf("unread total is %+v, want 2 messages in 2 conversations", total)
+	}
+
+	// Receipts left behind in a group the user no longer belongs to must
+	// not be counted.
+	if err := db.LeaveGroup(ctx, "group", alice); err != nil {
+		t.Fatal(err)
+	}
+	if conversations := getConversationsByID(t, db, alice); len(conversations) != 2 {
+		t.Errorf("after leaving the group got %d conversations, want 2", len(conversations))
+	}
+	total, err = db.GetUnreadTotal(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Messages != 1 || total.Conversations != 1 {
+		t.Errorf("after leaving the group unread total is %+v, want 1 message in 1 conversation", total)
+	}
+}
+
+// TestGetMyConversationsQueryCount checks that listing conversations runs
+// the same number of queries however many conversations the user has.
+func TestGetMyConversationsQueryCount(t *testing.T) {
+	var counts []int64
+	for _, n := range []int{10, 200} {
+		db := newCountingDatabase(t)
+		seedConversations(t, db, n, 5)
+		atomic.StoreInt64(&countingDriverQueries, 0)
+		conversations, err := db.GetMyConversations(context.Background(), "user-0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conversations) != n {
+			t.Fatalf("got %d conversations, want %d", len(conversations), n)
+		}
+		counts = append(counts, atomic.LoadInt64(&countingDriverQueries))
+	}
+	if counts[0] == 0 {
+		t.Fatal("no queries were counted")
+	}
+	if counts[0] != counts[1] {
+		t.Errorf("listing 10 conversations ran %d queries but listing 200 ran %d", counts[0], counts[1])
+	}
+}
+
+func BenchmarkGetMyConversations(b *testing.B) {
+	db := newTestDatabase(b)
+	seedConversations(b, db, 3000, 10)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conversations, err := db.GetMyConversations(ctx, "user-0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(conversations) != 3000 {
+			b.Fatalf("got %d conversations, want 3000", len(conversations))
+		}
+	}
+}
+
+func getConversationsByID(t *testing.T, db AppDatabase, userID string) map[string]Conversation {
+	t.Helper()
+	conversations, err := db.GetMyConversations(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := make(map[string]Conversation, len(conversations))
+	for _, conversation := range conversations {
+		byID[conversation.Id] = conversation
+	}
+	return byID
+}
+
+func assertMembers(t *testing.T, conversation Conversation, want ...string) {
+	t.Helper()
+	got := append([]string{}, conversation.Members...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("conversation %s has members %v, want %v", conversation.Id, got, want)
+	}
+}
+
+// seedConversations gives user-0 n conversations, every tenth a group with
+// a third member, each holding messages alternately sent by user-0 and the
+// peer. A third of the receipts are left unread.
+func seedConversations(tb testing.TB, db *appdbimpl, n, messages int) {
+	tb.Helper()
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO users (id, name) VALUES ('user-0', 'user0')`, nil},
+		{`WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		INSERT INTO users (id, name) SELECT 'user-' || i, 'user' || i FROM seq`, []interface{}{n}},
+		{`WITH RECURSIVE seq(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM seq WHERE i < ?)
+		INSERT INTO conversations (id, name, type, created_at)
+		SELECT 'conv-' || i,
+			CASE WHEN i % 10 = 0 THEN 'group' || i ELSE '' END,
+			CASE WHEN i % 10 = 0 THEN 'group' ELSE 'direct' END,
+			'2024-01-01T00:00:00Z'
+		FROM seq`, []interface{}{n}},
+		{`INSERT INTO conversation_members (conversationId, userId, role)
+		SELECT id, 'user-0', CASE WHEN type = 'group' THEN 'owner' ELSE 'member' END FROM conversations`, nil},
+		{`INSERT INTO conversation_members (conversationId, userId, role)
+		SELECT id, 'user-' || substr(id, 6), 'member' FROM conversations`, nil},
+		{`INSERT INTO conversation_members (conversationId, userId, role)
+		SELECT id, 'user-' || (CAST(substr(id, 6) AS INTEGER) % ? + 1), 'member'
+		FROM conversations WHERE type = 'group'`, []interface{}{n}},
+		{`WITH RECURSIVE seq(j) AS (SELECT 1 UNION ALL SELECT j + 1 FROM seq WHERE j < ?)
+		INSERT INTO messages (id, conversationId, senderId, content, timestamp)
+		SELECT c.id || '-msg-' || j, c.id,
+			CASE WHEN j % 2 = 0 THEN 'user-0' ELSE 'user-' || substr(c.id, 6) END,
+			'message ' || j,
+			printf('2024-%02d-%02dT00:00:00Z', 1 + (CAST(substr(c.id, 6) AS INTEGER) * 7 + j * 13) % 12, j)
+		FROM conversations c, seq`, []interface{}{messages}},
+		{`INSERT INTO read_receipts (messageId, userId, deliveredAt, readAt)
+		SELECT m.id, cm.userId, m.timestamp, CASE WHEN m.rowid % 3 = 0 THEN NULL ELSE m.timestamp END
+		FROM messages m
+		JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId != m.senderId`, nil},
+	}
+	for _, statement := range statements {
+		if _, err := db.c.Exec(statement.query, statement.args...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+var countingDriverQueries int64
+
+func init() {
+	sql.Register("sqlite3_counting", countingDriver{Driver: &sqlite3.SQLiteDriver{}})
+}
+
+// countingDriver counts the statements run through it. Its connections
+// only expose Prepare, so database/sql prepares every query.
+type countingDriver struct {
+	driver.Driver
+}
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{Conn: conn}, nil
+}
+
+type countingConn struct {
+	driver.Conn
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	atomic.AddInt64(&countingDriverQueries, 1)
+	return c.Conn.Prepare(query)
+}
+
+// newCountingDatabase migrates a database normally, then reopens it
+// through countingDriver. Only one such database is counted at a time.
+func newCountingDatabase(t *testing.T) *appdbimpl {
+	t.Helper()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.db")
+	migrated := newTestDatabaseAt(t, filename, dir)
+	conn, err := sql.Open("sqlite3_counting", DSN(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &appdbimpl{c: conn, blobs: migrated.blobs}
+}
+
+func TestForwardMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	for _, c := range []struct{ id, peer string }{{"source", bob}, {"first", carol}, {"second", bob}} {
+		if err := db.CreateDirectConversation(ctx, "conv-"+c.id, alice, c.peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.SaveMessage(ctx, "conv-source", bob, "original", "hello", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := db.ForwardMessage(ctx, alice, "original", []ForwardTarget{
+		{ConversationId: "conv-first", MessageId: "fwd-1"},
+		{ConversationId: "conv-missing", MessageId: "fwd-2"},
+	})
+	if err == nil {
+		t.Fatal("forwarding to a missing conversation succeeded")
+	}
+	var count int
+	if err := db.c.QueryRow(`SELECT COUNT(*) FROM messages WHERE isForward`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("a failed forward left %d copies behind", count)
+	}
+
+	forwarded, err := db.ForwardMessage(ctx, alice, "original", []ForwardTarget{
+		{ConversationId: "conv-first", MessageId: "fwd-1"},
+		{ConversationId: "conv-second", MessageId: "fwd-2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwarded) != 2 {
+		t.Fatalf("got %d forwarded messages, want 2", len(forwarded))
+	}
+	for i, want := range []string{"conv-first", "conv-second"} {
+		message := forwarded[i]
+		if message.ConversationId != want || message.Content != "hello" || message.SenderId != alice {
+			t.Errorf("forwarded message %d is %+v, want hello from alice in %s", i, message, want)
+		}
+	}
+}
+
+func TestMarkListedMessagesAsDelivered(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	alice, bob := users[0], users[1]
+	if err := db.CreateDirectConversation(ctx, "conv", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2"} {
+		if _, err := db.SaveMessage(ctx, "conv", bob, id, "hello", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range [][]string{{"m2"}, nil} {
+		delivered, err := db.MarkListedMessagesAsDelivered(ctx, alice, []string{"m2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(delivered) != fmt.Sprint(want) {
+			t.Errorf("delivered %v, want %v", delivered, want)
+		}
+	}
+	receipts, err := db.GetMessageReceipts(ctx, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].DeliveredAt != "" {
+		t.Errorf("m1 receipts are %+v, want it still pending", receipts)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	alice, bob := users[0], users[1]
+	if err := db.CreateDirectConversation(ctx, "conv", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	media, err := db.CreateMedia(ctx, "photo", "image/png", []byte("png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveMessage(ctx, "conv", alice, "msg", "hello", media.Id, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PinMessage(ctx, "conv", "msg", bob, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteMessage(ctx, "conv", "msg", bob); !errors.Is(err, ErrUnauthorizedToDeleteMessage) {
+		t.Fatalf("deleting someone else's message returned %v, want ErrUnauthorizedToDeleteMessage", err)
+	}
+	if err := db.DeleteMessage(ctx, "other", "msg", alice); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("deleting through another conversation returned %v, want ErrMessageDoesNotExist", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.DeleteMessage(ctx, "conv", "msg", alice); err != nil {
+			t.Fatalf("delete %d: %v", i+1, err)
+		}
+	}
+	message, err := db.GetMessage(ctx, "msg", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.Deleted || message.AttachmentId != "" {
+		t.Errorf("deleted message is %+v, want a tombstone without attachment", message)
+	}
+	pins, err := db.GetPinnedMessages(ctx, "conv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 0 {
+		t.Errorf("deleted message is still pinned: %+v", pins)
+	}
+	if _, err := db.GetMedia(ctx, media.Id); !errors.Is(err, ErrMediaDoesNotExist) {
+		t.Errorf("fetching the unused attachment returned %v, want ErrMediaDoesNotExist", err)
+	}
+}
+
+func TestHideMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	alice, bob := users[0], users[1]
+	if err := db.CreateDirectConversation(ctx, "conv", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveMessage(ctx, "conv", bob, "msg", "hello", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StarMessage(ctx, "msg", alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HideMessage(ctx, "other", "msg", alice); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("hiding through another conversation returned %v, want ErrMessageDoesNotExist", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.HideMessage(ctx, "conv", "msg", alice); err != nil {
+			t.Fatalf("hide %d: %v", i+1, err)
+		}
+	}
+	starred, err := db.GetStarredMessages(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starred) != 0 {
+		t.Errorf("hidden message is still starred: %+v", starred)
+	}
+	messages, _, err := db.GetMessagesForConversation(ctx, "conv", bob, MessagePage{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("bob sees %d messages, want the message only hidden for alice", len(messages))
+	}
+	if _, err := db.GetMessage(ctx, "msg", alice); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("alice fetching the message hidden for alice returned %v, want ErrMessageDoesNotExist", err)
+	}
+	if _, err := db.GetMessage(ctx, "msg", bob); err != nil {
+		t.Errorf("bob fetching the message: %v", err)
+	}
+}
@@ -1,9 +1,15 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tassdam/wasa/service/blobstore"
 )
 
 var ErrUserDoesNotExist = errors.New("User does not exist")
@@ -11,52 +17,160 @@ var ErrConversationDoesNotExist = errors.New("Conversation does not exist")
 var ErrMessageDoesNotExist = errors.New("Message does not exist")
 var ErrCommentDoesNotExist = errors.New("Comment does not exist")
 var ErrUnauthorizedToDeleteMessage = errors.New("Unauthorized To Delete Message")
+var ErrInvalidSearchQuery = errors.New("Invalid search query")
 var ErrGroupDoesNotExist = errors.New("Group does not exist")
+var ErrSessionDoesNotExist = errors.New("Session does not exist")
+var ErrSessionExpired = errors.New("Session expired")
+var ErrUserNotInConversation = errors.New("User is not a member of the conversation")
+var ErrInsufficientGroupRole = errors.New("Insufficient group role")
+var ErrInvalidReplyTarget = errors.New("Reply target does not exist in the conversation")
+var ErrMediaDoesNotExist = errors.New("Media does not exist")
+var ErrTooManyPinnedMessages = errors.New("Too many pinned messages")
+var ErrQueryCanceled = errors.New("Query canceled")
+var ErrQueryTimeout = errors.New("Query timed out")
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+const SelfConversationName = "Saved Messages"
+
+// DeletedMessageContent replaces the content of messages deleted for everyone.
+const DeletedMessageContent = "This message was deleted"
+
+const (
+	MessageTypeText   = "text"
+	MessageTypeSystem = "system"
+)
 
 type User struct {
-	Id    string `json:"id"`
-	Name  string `json:"name"`
-	Photo []byte `json:"photo,omitempty"`
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	PhotoId string `json:"photoId,omitempty"`
 }
 
 type Group struct {
-	Id    string `json:"id"`
-	Name  string `json:"name"`
-	Photo []byte `json:"photo,omitempty"`
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	PhotoId string `json:"photoId,omitempty"`
+}
+
+type Media struct {
+	Id          string
+	ContentType string
+	Size        int64
+	Sha256      string
+	Data        []byte
+	CreatedAt   string
 }
 
 type Conversation struct {
-	Id                string         `json:"id"`
-	Name              string         `json:"name"`
-	Type              string         `json:"type"`
-	CreatedAt         string         `json:"createdAt"`
-	Members           []string       `json:"members"`
-	LastMessage       *Message       `json:"lastMessage,omitempty"`
-	Messages          []Message      `json:"messages,omitempty"`
-	ConversationPhoto sql.NullString `json:"conversationPhoto,omitempty"`
+	Id                  string            `json:"id"`
+	Name                string            `json:"name"`
+	Type                string            `json:"type"`
+	CreatedAt           string            `json:"createdAt"`
+	Members             []string          `json:"members"`
+	LastMessage         *Message          `json:"lastMessage,omitempty"`
+	Messages            []Message         `json:"messages,omitempty"`
+	ConversationPhotoId string            `json:"conversationPhotoId,omitempty"`
+	MemberRoles         map[string]string `json:"memberRoles,omitempty"`
+	HasMoreMessages     bool              `json:"hasMoreMessages,omitempty"`
+	PinnedMessages      []PinnedMessage   `json:"pinnedMessages,omitempty"`
+	UnreadCount         int               `json:"unreadCount,omitempty"`
+	// FirstUnreadMessageId is the oldest message the user has not read.
+	FirstUnreadMessageId string `json:"firstUnreadMessageId,omitempty"`
+}
+
+// UnreadTotal counts a user's unread messages and the conversations they
+// are spread over.
+type UnreadTotal struct {
+	Messages      int `json:"unreadCount"`
+	Conversations int `json:"unreadConversations"`
 }
 
 type Message struct {
-	Id                string   `json:"id"`
-	ConversationId    string   `json:"conversationId"`
-	SenderId          string   `json:"senderId"`
-	SenderName        string   `json:"senderName"`
-	Content           string   `json:"content"`
-	Timestamp         string   `json:"timestamp"`
-	Attachment        []byte   `json:"attachment"`
-	SenderPhoto       string   `json:"senderPhoto,omitempty"`
-	ReactionCount     int      `json:"reactionCount"`
-	ReactingUserNames []string `json:"reactingUserNames"`
-	Status            string   `json:"status"`
-	ReplyTo           string   `json:"replyTo,omitempty"`
-	ReplyContent      string   `json:"replyContent,omitempty"`
-	ReplySenderName   string   `json:"replySenderName,omitempty"`
-	ReplyAttachment   []byte   `json:"replyAttachment,omitempty"`
-}
-
-type Comment struct {
-	Id       string `json:"id"`
-	AuthorId string `json:"authorId"`
+	Id                string     `json:"id"`
+	ConversationId    string     `json:"conversationId"`
+	SenderId          string     `json:"senderId"`
+	SenderName        string     `json:"senderName"`
+	Type              string     `json:"type"`
+	Content           string     `json:"content"`
+	Timestamp         string     `json:"timestamp"`
+	AttachmentId      string     `json:"attachmentId,omitempty"`
+	SenderPhotoId     string     `json:"senderPhotoId,omitempty"`
+	Reactions         []Reaction `json:"reactions,omitempty"`
+	Edited            bool       `json:"edited,omitempty"`
+	Starred           bool       `json:"starred,omitempty"`
+	Deleted           bool       `json:"deleted,omitempty"`
+	EditedAt          string     `json:"editedAt,omitempty"`
+	Status            string     `json:"status"`
+	ReplyTo           string     `json:"replyTo,omitempty"`
+	ReplyDeleted      bool       `json:"replyDeleted,omitempty"`
+	ReplyContent      string     `json:"replyContent,omitempty"`
+	ReplySenderName   string     `json:"replySenderName,omitempty"`
+	ReplyAttachmentId string     `json:"replyAttachmentId,omitempty"`
+	// Forwarded messages link to the message they were copied from, which
+	// may itself be a forward, and name the author of the original.
+	Forwarded              bool   `json:"forwarded,omitempty"`
+	ForwardedFromMessageId string `json:"forwardedFromMessageId,omitempty"`
+	ForwardedFromUserId    string `json:"forwardedFromUserId,omitempty"`
+	ForwardedFromName      string `json:"forwardedFromName,omitempty"`
+}
+
+// StarredMessage is a message the user saved for later, with the name of
+// its conversation as the user sees it.
+type StarredMessage struct {
+	Message
+	ConversationName string `json:"conversationName"`
+	ConversationType string `json:"conversationType"`
+	StarredAt        string `json:"starredAt"`
+}
+
+// PinnedMessage is a message pinned in a conversation by PinnedBy.
+type PinnedMessage struct {
+	Message      Message `json:"message"`
+	PinnedBy     string  `json:"pinnedBy"`
+	PinnedByName string  `json:"pinnedByName"`
+	PinnedAt     string  `json:"pinnedAt"`
+}
+
+// Receipt tracks delivery and reading of a message by one recipient.
+// DeliveredAt and ReadAt are empty until the event happens.
+type Receipt struct {
+	UserId      string `json:"userId"`
+	UserName    string `json:"userName"`
+	DeliveredAt string `json:"deliveredAt,omitempty"`
+	ReadAt      string `json:"readAt,omitempty"`
+}
+
+type MessagePage struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+// MessageEdit is a superseded revision of a message; CreatedAt is when
+// that revision was written.
+type MessageEdit struct {
+	Revision  int    `json:"revision"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// ForwardTarget names a conversation a message is forwarded to and the id
+// of the copy created there.
+type ForwardTarget struct {
+	ConversationId string
+	MessageId      string
+}
+
+// Reaction aggregates the users who reacted to a message with one emoji.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Users []User `json:"users"`
 }
 
 type ReadReceipt struct {
@@ -67,118 +181,155 @@ type ReadReceipt struct {
 }
 
 type AppDatabase interface {
-	Ping() error
-	GetUserByName(name string) (User, error)
-	CreateUser(u User) (User, error)
-	UpdateUserName(userId string, newName string) (User, error)
-	UpdateUserPhoto(userID string, photo []byte) error
-	SearchUsersByName(username string) ([]User, error)
-	GetDirectConversation(senderID, recipientID string) (string, error)
-	CreateDirectConversation(conversationID, senderID, recipientID string) error
-	SaveMessage(conversationID, senderID, messageID, content string, attachment []byte, replyTo string) (Message, error)
-	InsertDeliveryReceipt(messageID, userID, deliveredAt string) error
-	IsUserInConversation(conversationID, userID string) (bool, error)
-	GetConversationDetails(conversationID, currentUserID string) (Conversation, error)
-	GetMessagesForConversation(conversationID string) ([]Message, error)
-	GetMyConversations(userID string) ([]Conversation, error)
-	GetConversationMembers(conversationID string) ([]string, error)
-	GetUsersPhoto(userID string) (User, error)
-	DeleteMessage(conversationID, messageID, userID string) error
-	GetMessage(messageID, userID string) (Message, error)
-	CreateGroupConversation(conversationID string, memberIDs []string, name string, photo []byte) error
-	GetMyGroups(userID string) ([]Conversation, error)
-	GetGroupInfo(groupID string) (Conversation, error)
-	UpdateGroupName(groupId, newName string) error
-	UpdateGroupPhoto(groupID string, photo []byte) error
-	LeaveGroup(groupID, userID string) error
-	AddUserToGroup(conversationID string, userID string) error
-	CommentMessage(commentID, messageID, authorID string) error
-	UncommentMessage(messageID, authorID string) error
-	MarkMessagesAsRead(conversationID, userID string) error
+	Ping(ctx context.Context) error
+	GetUserByName(ctx context.Context, name string) (User, error)
+	GetUserById(ctx context.Context, id string) (User, error)
+	CreateUser(ctx context.Context, u User) (User, error)
+	UpdateUserName(ctx context.Context, userId string, newName string) (User, error)
+	UpdateUserPhoto(ctx context.Context, userID string, photoID string) error
+	SearchUsersByName(ctx context.Context, username string) ([]User, error)
+	GetDirectConversation(ctx context.Context, senderID, recipientID string) (string, error)
+	CreateDirectConversation(ctx context.Context, conversationID, senderID, recipientID string) error
+	SaveMessage(ctx context.Context, conversationID, senderID, messageID, content string, attachmentID string, replyTo string) (Message, error)
+	ForwardMessage(ctx context.Context, senderID, sourceMessageID string, targets []ForwardTarget) ([]Message, error)
+	IsUserInConversation(ctx context.Context, conversationID, userID string) (bool, error)
+	GetConversationDetails(ctx context.Context, conversationID, currentUserID string, page MessagePage) (Conversation, error)
+	GetMessagesForConversation(ctx context.Context, conversationID, userID string, page MessagePage) ([]Message, bool, error)
+	GetMyConversations(ctx context.Context, userID string) ([]Conversation, error)
+	GetConversationMembers(ctx context.Context, conversationID string) ([]string, error)
+	GetUsersPhoto(ctx context.Context, userID string) (User, error)
+	DeleteMessage(ctx context.Context, conversationID, messageID, userID string) error
+	HideMessage(ctx context.Context, conversationID, messageID, userID string) error
+	SearchMessages(ctx context.Context, userID string, search MessageSearch) ([]MessageSearchResult, bool, error)
+	GetMessage(ctx context.Context, messageID, userID string) (Message, error)
+	CreateGroupConversation(ctx context.Context, conversationID, creatorID string, memberIDs []string, name string, photoID string) error
+	GetMyGroups(ctx context.Context, userID string) ([]Conversation, error)
+	GetGroupInfo(ctx context.Context, groupID string) (Conversation, error)
+	UpdateGroupName(ctx context.Context, groupId, newName string) error
+	UpdateGroupPhoto(ctx context.Context, groupID string, photoID string) error
+	LeaveGroup(ctx context.Context, groupID, userID string) error
+	AddUserToGroup(ctx context.Context, conversationID string, userID string) error
+	GetMemberRole(ctx context.Context, conversationID, userID string) (string, error)
+	RemoveGroupMember(ctx context.Context, groupID, actorID, userID string) error
+	SetMemberRole(ctx context.Context, groupID, actorID, userID, role string) error
+	TransferGroupOwnership(ctx context.Context, groupID, fromUserID, toUserID string) error
+	SaveSystemMessage(ctx context.Context, conversationID, actorID, messageID, content string) (Message, error)
+	AddReaction(ctx context.Context, messageID, userID, emoji string) error
+	RemoveReaction(ctx context.Context, messageID, userID, emoji string) error
+	ToggleReaction(ctx context.Context, messageID, userID, emoji string) (bool, error)
+	GetReactions(ctx context.Context, messageID string) ([]Reaction, error)
+	EditMessage(ctx context.Context, messageID, content string) (string, error)
+	GetMessageEdits(ctx context.Context, messageID string) ([]MessageEdit, error)
+	PinMessage(ctx context.Context, conversationID, messageID, userID string, limit int) (bool, error)
+	UnpinMessage(ctx context.Context, conversationID, messageID string) (bool, error)
+	GetPinnedMessages(ctx context.Context, conversationID string) ([]PinnedMessage, error)
+	StarMessage(ctx context.Context, messageID, userID string) error
+	UnstarMessage(ctx context.Context, messageID, userID string) error
+	GetStarredMessages(ctx context.Context, userID string) ([]StarredMessage, error)
+	MarkMessagesAsRead(ctx context.Context, conversationID, userID, upToMessageID string) (int64, error)
+	GetUnreadTotal(ctx context.Context, userID string) (UnreadTotal, error)
+	MarkListedMessagesAsDelivered(ctx context.Context, userID string, messageIDs []string) ([]string, error)
+	MarkMessageAsDelivered(ctx context.Context, messageID, userID string) (bool, error)
+	GetMessageReceipts(ctx context.Context, messageID string) ([]Receipt, error)
+	CreateSession(ctx context.Context, token, userID string, expiresAt time.Time) error
+	GetSessionUser(ctx context.Context, token string) (User, error)
+	DeleteSession(ctx context.Context, token string) error
+	DeleteExpiredSessions(ctx context.Context) error
+	CreateMedia(ctx context.Context, mediaID, contentType string, data []byte) (Media, error)
+	GetMedia(ctx context.Context, mediaID string) (Media, error)
+	GetMediaData(ctx context.Context, media Media) ([]byte, error)
+	CanUserAccessMedia(ctx context.Context, mediaID, userID string) (bool, error)
+	DeleteMediaIfUnused(ctx context.Context, mediaID string) error
+	ListMediaHashes(ctx context.Context) ([]string, error)
+	SetPresenceVisibility(ctx context.Context, userID string, visible bool) error
+	GetPresenceVisibility(ctx context.Context, userIDs []string) (map[string]bool, error)
+	GetConversationPartners(ctx context.Context, userID string, candidateIDs []string) (map[string]bool, error)
 }
 
 type appdbimpl struct {
-	c *sql.DB
+	c            *sql.DB
+	blobs        blobstore.BlobStore
+	queryTimeout time.Duration
+	// contentLocks serialize storing and deleting blobs by hash; see
+	// lockContent.
+	contentLocks [16]sync.Mutex
 }
 
-func New(db *sql.DB) (AppDatabase, error) {
+// New returns an AppDatabase whose operations are each bounded by
+// queryTimeout, or only by their context if it is zero. The schema must
+// have been brought up to date with Migrate.
+func New(db *sql.DB, blobs blobstore.BlobStore, queryTimeout time.Duration) (AppDatabase, error) {
 	if db == nil {
 		return nil, errors.New("database is required when building an AppDatabase")
 	}
+	if blobs == nil {
+		return nil, errors.New("blob store is required when building an AppDatabase")
+	}
 	_, err := db.Exec("PRAGMA foreign_keys = ON")
 	if err != nil {
 		return nil, err
 	}
-	var tableName string
-	err = db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name='users';`).Scan(&tableName)
-	if errors.Is(err, sql.ErrNoRows) {
-		usersTable := `CREATE TABLE users (
-			id TEXT NOT NULL PRIMARY KEY,
-			name TEXT NOT NULL UNIQUE,
-			photo BLOB
-		);`
-		conversationsTable := `CREATE TABLE conversations (
-			id TEXT NOT NULL PRIMARY KEY,
-			name TEXT NOT NULL,
-			type TEXT NOT NULL,
-			created_at TEXT NOT NULL,
-			conversationPhoto BLOB
-		);`
-		conversationMembersTable := `CREATE TABLE conversation_members (
-			conversationId TEXT NOT NULL,
-			userId TEXT NOT NULL,
-			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
-			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
-			PRIMARY KEY(conversationId, userId)
-		);`
-		messagesTable := `CREATE TABLE messages (
-			id TEXT NOT NULL PRIMARY KEY,
-			conversationId TEXT NOT NULL,
-			senderId TEXT NOT NULL,
-			content TEXT NOT NULL,
-			timestamp TEXT NOT NULL,
-			attachment BLOB,
-			replyTo TEXT,  
-			FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
-			FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-		commentsTable := `CREATE TABLE comments (
-			id TEXT NOT NULL PRIMARY KEY,
-			messageId TEXT NOT NULL,
-			authorId TEXT NOT NULL,
-			UNIQUE(messageId, authorId),
-			FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (authorId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-		readReceiptsTable := `CREATE TABLE read_receipts (
-			messageId TEXT NOT NULL,
-			userId TEXT NOT NULL,
-			deliveredAt TEXT NOT NULL,
-			readAt TEXT, 
-			PRIMARY KEY (messageId, userId),
-			FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
-			FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
-		);`
-		creationQueries := []string{
-			usersTable,
-			conversationsTable,
-			conversationMembersTable,
-			messagesTable,
-			commentsTable,
-			readReceiptsTable,
+	if err := checkSchema(context.Background(), db); err != nil {
+		return nil, err
+	}
+	return &appdbimpl{c: db, blobs: blobs, queryTimeout: queryTimeout}, nil
+}
+
+// DSN returns the go-sqlite3 data source name for filename. Transactions
+// take the write lock when they begin, so concurrent writers wait for each
+// other instead of failing to upgrade a read lock.
+func DSN(filename string) string {
+	options := "_foreign_keys=on&_txlock=immediate&_busy_timeout=5000"
+	if strings.Contains(filename, "?") {
+		return filename + "&" + options
+	}
+	return filename + "?" + options
+}
+
+func (db *appdbimpl) Ping(ctx context.Context) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.c.PingContext(ctx)
+}
+
+// operation bounds a database operation by the query timeout. The returned
+// function must be deferred; it reports a failure caused by the context
+// ending as ErrQueryCanceled or ErrQueryTimeout.
+func (db *appdbimpl) operation(ctx context.Context, err *error) (context.Context, func()) {
+	cancel := func() {}
+	if db.queryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, db.queryTimeout)
+	}
+	return ctx, func() {
+		defer cancel()
+		if *err == nil || errors.Is(*err, ErrQueryCanceled) || errors.Is(*err, ErrQueryTimeout) {
+			return
 		}
-		for _, q := range creationQueries {
-			_, execErr := db.Exec(q)
-			if execErr != nil {
-				return nil, fmt.Errorf("error creating database structure: %w", execErr)
-			}
+		switch ctxErr := ctx.Err(); {
+		case errors.Is(ctxErr, context.DeadlineExceeded):
+			*err = fmt.Errorf("%w: %v", ErrQueryTimeout, *err)
+		case errors.Is(ctxErr, context.Canceled):
+			*err = fmt.Errorf("%w: %v", ErrQueryCanceled, *err)
 		}
-	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return nil, err
 	}
-	return &appdbimpl{c: db}, nil
 }
 
-func (db *appdbimpl) Ping() error {
-	return db.c.Ping()
+// withTx runs fn in a transaction, committing it when fn succeeds and
+// rolling it back otherwise. Errors returned by fn are passed through
+// unchanged.
+func (db *appdbimpl) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.c.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+	return nil
 }
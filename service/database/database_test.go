@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tassdam/wasa/service/blobstore"
+)
+
+func newTestDatabase(tb testing.TB) *appdbimpl {
+	tb.Helper()
+	dir := tb.TempDir()
+	return newTestDatabaseAt(tb, filepath.Join(dir, "test.db"), dir)
+}
+
+// newTestDatabaseAt migrates the database in filename, keeping blobs in
+// a directory under dir.
+func newTestDatabaseAt(tb testing.TB, filename, dir string) *appdbimpl {
+	tb.Helper()
+	conn, err := sql.Open("sqlite3", DSN(filename))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		_ = conn.Close()
+	})
+	blobs, err := blobstore.NewFS(filepath.Join(dir, "blobs"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, _, err := Migrate(conn, blobs); err != nil {
+		tb.Fatal(err)
+	}
+	db, err := New(conn, blobs, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return db.(*appdbimpl)
+}
+
+func createTestUsers(tb testing.TB, db AppDatabase, names ...string) []string {
+	tb.Helper()
+	ids := make([]string, len(names))
+	for i, name := range names {
+		ids[i] = "user-" + name
+		if _, err := db.CreateUser(context.Background(), User{Id: ids[i], Name: name}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestConcurrentSaveMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	const senders = 120
+	var wg sync.WaitGroup
+	errs := make(chan error, senders)
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.SaveMessage(ctx, "conv", users[i%2], fmt.Sprintf("msg-%d", i), "hello", "", "")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	var messages, receipts int
+	if err := db.c.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.c.QueryRow(`SELECT COUNT(*) FROM read_receipts`).Scan(&receipts); err != nil {
+		t.Fatal(err)
+	}
+	if messages != senders || receipts != senders {
+		t.Errorf("got %d messages and %d receipts, want %d of each", messages, receipts, senders)
+	}
+}
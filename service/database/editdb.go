@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EditMessage replaces the content of a message, keeping the previous
+// content as a revision in message_edits.
+func (db *appdbimpl) EditMessage(ctx context.Context, messageID, content string) (_ string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	editedAt := time.Now().Format(time.RFC3339)
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var previous, writtenAt string
+		err := tx.QueryRowContext(ctx, `
+			SELECT content, IFNULL(editedAt, timestamp) FROM messages WHERE id = ?
+		`, messageID).Scan(&previous, &writtenAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrMessageDoesNotExist
+		} else if err != nil {
+			return fmt.Errorf("error fetching message: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO message_edits (messageId, revision, content, createdAt)
+			SELECT ?, COUNT(*) + 1, ?, ? FROM message_edits WHERE messageId = ?
+		`, messageID, previous, writtenAt, messageID)
+		if err != nil {
+			return fmt.Errorf("error saving message revision: %w", err)
+		}
+		// A deleted message keeps its row as a tombstone, which must not
+		// be brought back by an edit.
+		res, err := tx.ExecContext(ctx, `
+			UPDATE messages SET content = ?, editedAt = ? WHERE id = ? AND deletedAt IS NULL
+		`, content, editedAt, messageID)
+		if err != nil {
+			return fmt.Errorf("error updating message: %w", err)
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrMessageDoesNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return editedAt, nil
+}
+
+// GetMessageEdits returns the previous revisions of a message, oldest first.
+func (db *appdbimpl) GetMessageEdits(ctx context.Context, messageID string) (_ []MessageEdit, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT revision, content, createdAt
+		FROM message_edits
+		WHERE messageId = ?
+		ORDER BY revision
+	`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching message revisions: %w", err)
+	}
+	defer rows.Close()
+	var edits []MessageEdit
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.Revision, &edit.Content, &edit.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning message revision: %w", err)
+		}
+		edits = append(edits, edit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating message revisions: %w", err)
+	}
+	return edits, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEditMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveMessage(ctx, "conv", users[0], "msg", "first", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.EditMessage(ctx, "missing", "nothing"); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("editing a missing message returned %v, want ErrMessageDoesNotExist", err)
+	}
+	for _, content := range []string{"second", "third"} {
+		if _, err := db.EditMessage(ctx, "msg", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message, err := db.GetMessage(ctx, "msg", users[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Content != "third" {
+		t.Errorf("message content is %q, want third", message.Content)
+	}
+	edits, err := db.GetMessageEdits(ctx, "msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 2 || edits[0].Revision != 1 || edits[0].Content != "first" || edits[1].Content != "second" {
+		t.Errorf("revisions are %+v, want first and second", edits)
+	}
+
+	if err := db.DeleteMessage(ctx, "conv", "msg", users[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.EditMessage(ctx, "msg", "fourth"); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("editing a deleted message returned %v, want ErrMessageDoesNotExist", err)
+	}
+	message, err = db.GetMessage(ctx, "msg", users[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.Deleted || message.Content != "" {
+		t.Errorf("edited tombstone is %+v, want it to stay deleted", message)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build sqlite_fts5
+
+package database
+
+// FullTextSearch reports whether message search uses an SQLite FTS5 index.
+// It requires building with -tags sqlite_fts5.
+const FullTextSearch = true
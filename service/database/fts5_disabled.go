@@ -0,0 +1,7 @@
+//go:build !sqlite_fts5
+
+package database
+
+// FullTextSearch reports whether message search uses an SQLite FTS5 index.
+// Without the sqlite_fts5 build tag, search falls back to substring matching.
+const FullTextSearch = false
@@ -0,0 +1,49 @@
+//go:build !sqlite_fts5
+
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchMessagesLikeFallback(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	for id, content := range map[string]string{
+		"percent":    "100% done",
+		"plain":      "1000 done",
+		"underscore": "snake_case",
+		"letter":     "snakeXcase",
+		"upper":      "MEETING",
+	} {
+		if _, err := db.SaveMessage(ctx, "conv", users[0], id, content, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// LIKE wildcards in the input match themselves only.
+		{"100%", "percent"},
+		{"e_c", "underscore"},
+		// Matching ignores ASCII case and finds substrings.
+		{"eeti", "upper"},
+		{"meet*", "upper"},
+	}
+	for _, tt := range tests {
+		results, _, err := db.SearchMessages(ctx, users[0], MessageSearch{Query: tt.query, Limit: 10})
+		if err != nil {
+			t.Errorf("searching %q: %v", tt.query, err)
+			continue
+		}
+		if len(results) != 1 || results[0].MessageId != tt.want {
+			t.Errorf("searching %q found %+v, want only %s", tt.query, results, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build sqlite_fts5
+
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchMessagesFTS5(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	for id, content := range map[string]string{
+		"cafe":   "See you at the Café",
+		"secret": "the secret plan",
+		"meet":   "meet me there",
+	} {
+		if _, err := db.SaveMessage(ctx, "conv", users[0], id, content, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"cafe", 1},
+		{"mee*", 1},
+		{"mee", 0},
+		// Operators and column filters in the input are searched for as
+		// text instead of being interpreted, and never make the query fail.
+		{"meet OR secret", 0},
+		{"content:secret", 0},
+		{"NEAR(secret plan", 0},
+		{`secret" OR "meet`, 0},
+		{"-secret", 1},
+		{"^secret", 1},
+	}
+	for _, tt := range tests {
+		results, _, err := db.SearchMessages(ctx, users[0], MessageSearch{Query: tt.query, Limit: 10})
+		if err != nil {
+			t.Errorf("searching %q: %v", tt.query, err)
+			continue
+		}
+		if len(results) != tt.want {
+			t.Errorf("searching %q found %d messages, want %d", tt.query, len(results), tt.want)
+		}
+	}
+
+	// The index follows edits.
+	if _, err := db.EditMessage(ctx, "secret", "the public plan"); err != nil {
+		t.Fatal(err)
+	}
+	if results, _, err := db.SearchMessages(ctx, users[0], MessageSearch{Query: "secret", Limit: 10}); err != nil || len(results) != 0 {
+		t.Errorf("searching the edited-out word found %d messages (%v), want none", len(results), err)
+	}
+}
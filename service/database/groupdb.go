@@ -1,45 +1,69 @@
 package database
 
 import (
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
-	"strings"
 	"time"
 )
 
-func (db *appdbimpl) CreateGroupConversation(conversationID string, memberIDs []string, name string, photo []byte) error {
-	_, err := db.c.Exec(`
-        INSERT INTO conversations (id, name, type, created_at, conversationPhoto)
-        VALUES (?, ?, 'group', ?, ?)
-    `, conversationID, name, time.Now().Format(time.RFC3339), photo)
-	if err != nil {
-		return fmt.Errorf("error creating new conversation: %w", err)
-	}
-	for _, memberID := range memberIDs {
-		_, err = db.c.Exec(`
-            INSERT INTO conversation_members (conversationId, userId)
-            VALUES (?, ?)
-        `, conversationID, memberID)
+func (db *appdbimpl) CreateGroupConversation(ctx context.Context, conversationID, creatorID string, memberIDs []string, name string, photoID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO conversations (id, name, type, created_at, photoId)
+			VALUES (?, ?, 'group', ?, NULLIF(?, ''))
+		`, conversationID, name, time.Now().Format(time.RFC3339), photoID)
 		if err != nil {
-			return fmt.Errorf("error adding member %s to conversation_members: %w", memberID, err)
+			return fmt.Errorf("error creating new conversation: %w", err)
 		}
-	}
-	return nil
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO conversation_members (conversationId, userId, role)
+			VALUES (?, ?, ?)
+		`, conversationID, creatorID, RoleOwner)
+		if err != nil {
+			return fmt.Errorf("error adding owner %s to conversation_members: %w", creatorID, err)
+		}
+		added := map[string]bool{creatorID: true}
+		for _, memberID := range memberIDs {
+			if added[memberID] {
+				continue
+			}
+			var exists bool
+			err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, memberID).Scan(&exists)
+			if err != nil {
+				return fmt.Errorf("error checking member %s: %w", memberID, err)
+			} else if !exists {
+				return ErrUserDoesNotExist
+			}
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO conversation_members (conversationId, userId, role)
+				VALUES (?, ?, ?)
+			`, conversationID, memberID, RoleMember)
+			if err != nil {
+				return fmt.Errorf("error adding member %s to conversation_members: %w", memberID, err)
+			}
+			added[memberID] = true
+		}
+		return nil
+	})
 }
 
-func (db *appdbimpl) GetMyGroups(userID string) ([]Conversation, error) {
+func (db *appdbimpl) GetMyGroups(ctx context.Context, userID string) (_ []Conversation, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	query := `
     SELECT 
         c.id,
         c.name,
-        c.conversationPhoto as photo
+        IFNULL(c.photoId, '') AS photoId
     FROM conversations c
     JOIN conversation_members cm ON c.id = cm.conversationId
     WHERE cm.userId = ? AND c.type = 'group'
     ORDER BY c.created_at DESC;
     `
-	rows, err := db.c.Query(query, userID)
+	rows, err := db.c.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching groups: %w", err)
 	}
@@ -47,21 +71,14 @@ func (db *appdbimpl) GetMyGroups(userID string) ([]Conversation, error) {
 	var groups []Conversation
 	for rows.Next() {
 		var group Conversation
-		var photo sql.NullString
 		err := rows.Scan(
 			&group.Id,
 			&group.Name,
-			&photo,
+			&group.ConversationPhotoId,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("error scanning group: %w", err)
 		}
-		if photo.Valid {
-			group.ConversationPhoto.String = base64.StdEncoding.EncodeToString([]byte(photo.String))
-			group.ConversationPhoto.Valid = true
-		} else {
-			group.ConversationPhoto = sql.NullString{String: "", Valid: false}
-		}
 		groups = append(groups, group)
 	}
 	if err = rows.Err(); err != nil {
@@ -70,24 +87,22 @@ func (db *appdbimpl) GetMyGroups(userID string) ([]Conversation, error) {
 	return groups, nil
 }
 
-func (db *appdbimpl) GetGroupInfo(groupID string) (Conversation, error) {
+func (db *appdbimpl) GetGroupInfo(ctx context.Context, groupID string) (_ Conversation, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var group Conversation
-	var photo []byte
-	var membersCSV sql.NullString
-	err := db.c.QueryRow(`
+	err = db.c.QueryRowContext(ctx, `
         SELECT 
             c.id,
             c.name,
-            c.conversationPhoto,
-            (SELECT GROUP_CONCAT(userId) FROM conversation_members WHERE conversationId = c.id) AS members
+            IFNULL(c.photoId, '')
         FROM conversations c
         WHERE c.id = ? AND c.type = 'group'`,
 		groupID,
 	).Scan(
 		&group.Id,
 		&group.Name,
-		&photo,
-		&membersCSV,
+		&group.ConversationPhotoId,
 	)
 	if err == sql.ErrNoRows {
 		return Conversation{}, ErrGroupDoesNotExist
@@ -95,24 +110,36 @@ func (db *appdbimpl) GetGroupInfo(groupID string) (Conversation, error) {
 	if err != nil {
 		return Conversation{}, fmt.Errorf("error fetching group by ID: %w", err)
 	}
-	if len(photo) > 0 {
-		group.ConversationPhoto = sql.NullString{
-			String: base64.StdEncoding.EncodeToString(photo),
-			Valid:  true,
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT userId, role
+        FROM conversation_members
+        WHERE conversationId = ?`,
+		groupID,
+	)
+	if err != nil {
+		return Conversation{}, fmt.Errorf("error fetching group members: %w", err)
+	}
+	defer rows.Close()
+	group.Members = []string{}
+	group.MemberRoles = map[string]string{}
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return Conversation{}, fmt.Errorf("error scanning group member: %w", err)
 		}
-	} else {
-		group.ConversationPhoto = sql.NullString{Valid: false}
+		group.Members = append(group.Members, userID)
+		group.MemberRoles[userID] = role
 	}
-	if membersCSV.Valid {
-		group.Members = strings.Split(membersCSV.String, ",")
-	} else {
-		group.Members = []string{}
+	if err := rows.Err(); err != nil {
+		return Conversation{}, fmt.Errorf("error iterating group members: %w", err)
 	}
 	return group, nil
 }
 
-func (db *appdbimpl) UpdateGroupName(groupId, newName string) error {
-	res, err := db.c.Exec(`UPDATE conversations SET name=? WHERE id=?`, newName, groupId)
+func (db *appdbimpl) UpdateGroupName(ctx context.Context, groupId, newName string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	res, err := db.c.ExecContext(ctx, `UPDATE conversations SET name=? WHERE id=? AND type='group'`, newName, groupId)
 	if err != nil {
 		return err
 	}
@@ -120,44 +147,228 @@ func (db *appdbimpl) UpdateGroupName(groupId, newName string) error {
 	if err != nil {
 		return err
 	} else if affected == 0 {
-		return ErrUserDoesNotExist
+		return ErrGroupDoesNotExist
 	}
 	return nil
 }
 
-func (db *appdbimpl) UpdateGroupPhoto(groupID string, photo []byte) error {
-	var exists bool
-	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM conversations WHERE id=?)`, groupID).Scan(&exists)
+func (db *appdbimpl) UpdateGroupPhoto(ctx context.Context, groupID string, photoID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var previousPhotoID string
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT IFNULL(photoId, '') FROM conversations WHERE id=? AND type='group'`, groupID).Scan(&previousPhotoID)
+		if err == sql.ErrNoRows {
+			return ErrGroupDoesNotExist
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE conversations SET photoId=? WHERE id=?`, photoID, groupID)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	if !exists {
-		return ErrGroupDoesNotExist
-	}
-	_, err = db.c.Exec(`UPDATE conversations SET conversationPhoto=? WHERE id=?`, photo, groupID)
+	return db.deleteMediaIfUnused(ctx, previousPhotoID)
+}
+
+func (db *appdbimpl) LeaveGroup(ctx context.Context, groupID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		var role sql.NullString
+		err := tx.QueryRowContext(ctx, `
+		SELECT cm.role
+		FROM conversations c
+		LEFT JOIN conversation_members cm ON cm.conversationId = c.id AND cm.userId = ?
+		WHERE c.id = ? AND c.type = 'group'
+		`, userID, groupID).Scan(&role)
+		if err == sql.ErrNoRows {
+			return ErrGroupDoesNotExist
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching member role: %w", err)
+		}
+		if !role.Valid {
+			return ErrUserNotInConversation
+		}
+		_, err = tx.ExecContext(ctx, `
+		DELETE FROM conversation_members WHERE conversationId = ? AND userId = ?
+		`, groupID, userID)
+		if err != nil {
+			return fmt.Errorf("error leaving group: %w", err)
+		}
+		if err := clearStarredMessages(ctx, tx, groupID, userID); err != nil {
+			return err
+		}
+		if role.String != RoleOwner {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `
+		UPDATE conversation_members SET role = ?
+		WHERE rowid = (
+			SELECT rowid FROM conversation_members
+			WHERE conversationId = ?
+			ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, rowid
+			LIMIT 1
+		)
+		`, RoleOwner, groupID)
+		if err != nil {
+			return fmt.Errorf("error transferring group ownership: %w", err)
+		}
+		return nil
+	})
+}
+
+func (db *appdbimpl) AddUserToGroup(ctx context.Context, conversationID string, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx,
+		"INSERT INTO conversation_members (conversationId, userId, role) VALUES (?, ?, ?)",
+		conversationID, userID, RoleMember,
+	)
 	if err != nil {
-		return err
+		return fmt.Errorf("error adding user to group: %w", err)
 	}
 	return nil
 }
 
-func (db *appdbimpl) LeaveGroup(groupID, userID string) error {
-	_, err := db.c.Exec(`
-	DELETE FROM conversation_members WHERE conversationId = ? AND userId = ?
-	`, groupID, userID)
+func (db *appdbimpl) GetMemberRole(ctx context.Context, conversationID, userID string) (_ string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var role string
+	err = db.c.QueryRowContext(ctx, `
+		SELECT role
+		FROM conversation_members
+		WHERE conversationId = ? AND userId = ?
+	`, conversationID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotInConversation
+	}
 	if err != nil {
-		return fmt.Errorf("error leaving group: %w", err)
+		return "", fmt.Errorf("error fetching member role: %w", err)
 	}
-	return nil
+	return role, nil
 }
 
-func (db *appdbimpl) AddUserToGroup(conversationID string, userID string) error {
-	_, err := db.c.Exec(
-		"INSERT INTO conversation_members (conversationId, userId) VALUES (?, ?)",
-		conversationID, userID,
-	)
+// memberRoles reads the roles of the acting member and of the member being
+// acted on within tx, so that the checks made on them hold until commit.
+// An actor who is no longer a member has no role in the group.
+func memberRoles(ctx context.Context, tx *sql.Tx, groupID, actorID, userID string) (actorRole, userRole string, err error) {
+	err = tx.QueryRowContext(ctx, `
+	SELECT role FROM conversation_members WHERE conversationId = ? AND userId = ?
+	`, groupID, actorID).Scan(&actorRole)
+	if err == sql.ErrNoRows {
+		return "", "", ErrInsufficientGroupRole
+	} else if err != nil {
+		return "", "", fmt.Errorf("error fetching member role: %w", err)
+	}
+	err = tx.QueryRowContext(ctx, `
+	SELECT role FROM conversation_members WHERE conversationId = ? AND userId = ?
+	`, groupID, userID).Scan(&userRole)
+	if err == sql.ErrNoRows {
+		return "", "", ErrUserNotInConversation
+	} else if err != nil {
+		return "", "", fmt.Errorf("error fetching member role: %w", err)
+	}
+	return actorRole, userRole, nil
+}
+
+func (db *appdbimpl) RemoveGroupMember(ctx context.Context, groupID, actorID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		actorRole, userRole, err := memberRoles(ctx, tx, groupID, actorID, userID)
+		if err != nil {
+			return err
+		}
+		// The owner can remove anyone else, admins only plain members.
+		if userRole == RoleOwner || (userRole == RoleAdmin && actorRole != RoleOwner) || actorRole == RoleMember {
+			return ErrInsufficientGroupRole
+		}
+		_, err = tx.ExecContext(ctx, `
+		DELETE FROM conversation_members WHERE conversationId = ? AND userId = ?
+		`, groupID, userID)
+		if err != nil {
+			return fmt.Errorf("error removing group member: %w", err)
+		}
+		return clearStarredMessages(ctx, tx, groupID, userID)
+	})
+}
+
+func (db *appdbimpl) SetMemberRole(ctx context.Context, groupID, actorID, userID, role string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		actorRole, userRole, err := memberRoles(ctx, tx, groupID, actorID, userID)
+		if err != nil {
+			return err
+		}
+		// Only the owner assigns roles, and ownership itself moves only
+		// through TransferGroupOwnership.
+		if actorRole != RoleOwner || userRole == RoleOwner {
+			return ErrInsufficientGroupRole
+		}
+		_, err = tx.ExecContext(ctx, `
+		UPDATE conversation_members SET role = ? WHERE conversationId = ? AND userId = ?
+		`, role, groupID, userID)
+		if err != nil {
+			return fmt.Errorf("error updating member role: %w", err)
+		}
+		return nil
+	})
+}
+
+func (db *appdbimpl) TransferGroupOwnership(ctx context.Context, groupID, fromUserID, toUserID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		// Demoting first, guarded by the current role, makes a second
+		// transfer by the same owner fail instead of leaving two owners.
+		res, err := tx.ExecContext(ctx, `
+		UPDATE conversation_members SET role = ? WHERE conversationId = ? AND userId = ? AND role = ?
+		`, RoleAdmin, groupID, fromUserID, RoleOwner)
+		if err != nil {
+			return fmt.Errorf("error demoting previous owner: %w", err)
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrInsufficientGroupRole
+		}
+		res, err = tx.ExecContext(ctx, `
+		UPDATE conversation_members SET role = ? WHERE conversationId = ? AND userId = ?
+		`, RoleOwner, groupID, toUserID)
+		if err != nil {
+			return fmt.Errorf("error promoting new owner: %w", err)
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return ErrUserNotInConversation
+		}
+		return nil
+	})
+}
+
+func (db *appdbimpl) SaveSystemMessage(ctx context.Context, conversationID, actorID, messageID, content string) (_ Message, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	timestamp := time.Now().Format(time.RFC3339)
+	_, err = db.c.ExecContext(ctx, `
+        INSERT INTO messages (id, conversationId, senderId, type, content, timestamp)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, messageID, conversationID, actorID, MessageTypeSystem, content, timestamp)
 	if err != nil {
-		return fmt.Errorf("error adding user to group: %w", err)
+		return Message{}, fmt.Errorf("error saving system message: %w", err)
 	}
-	return nil
+	return Message{
+		Id:             messageID,
+		ConversationId: conversationID,
+		SenderId:       actorID,
+		Type:           MessageTypeSystem,
+		Content:        content,
+		Timestamp:      timestamp,
+	}, nil
 }
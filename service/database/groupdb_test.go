@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestLeaveGroup(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	if err := db.CreateDirectConversation(ctx, "direct", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateGroupConversation(ctx, "group", alice, []string{bob, carol}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMemberRole(ctx, "group", alice, carol, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveMessage(ctx, "group", bob, "msg", "hello", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.StarMessage(ctx, "msg", alice); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.LeaveGroup(ctx, "direct", alice); !errors.Is(err, ErrGroupDoesNotExist) {
+		t.Errorf("leaving a direct conversation returned %v, want ErrGroupDoesNotExist", err)
+	}
+	if isMember, err := db.IsUserInConversation(ctx, "direct", alice); err != nil || !isMember {
+		t.Errorf("after leaving a direct conversation alice is member: %v (%v), want true", isMember, err)
+	}
+	if err := db.LeaveGroup(ctx, "missing", alice); !errors.Is(err, ErrGroupDoesNotExist) {
+		t.Errorf("leaving a missing group returned %v, want ErrGroupDoesNotExist", err)
+	}
+
+	if err := db.LeaveGroup(ctx, "group", alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LeaveGroup(ctx, "group", alice); !errors.Is(err, ErrUserNotInConversation) {
+		t.Errorf("leaving twice returned %v, want ErrUserNotInConversation", err)
+	}
+	group, err := db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertMembers(t, group, bob, carol)
+	if group.MemberRoles[carol] != RoleOwner {
+		t.Errorf("carol has role %q after the owner left, want the admin promoted to owner", group.MemberRoles[carol])
+	}
+	var stars int
+	if err := db.c.QueryRow(`SELECT COUNT(*) FROM starred_messages WHERE userId = ?`, alice).Scan(&stars); err != nil {
+		t.Fatal(err)
+	}
+	if stars != 0 {
+		t.Errorf("alice still has %d starred messages in the group they left", stars)
+	}
+}
+
+func TestCreateGroupWithUnknownMember(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	err := db.CreateGroupConversation(ctx, "group", users[0], []string{users[1], "user-nobody"}, "friends", "")
+	if !errors.Is(err, ErrUserDoesNotExist) {
+		t.Fatalf("creating a group with an unknown member returned %v, want ErrUserDoesNotExist", err)
+	}
+	if _, err := db.GetGroupInfo(ctx, "group"); !errors.Is(err, ErrGroupDoesNotExist) {
+		t.Errorf("the failed group was created anyway: %v", err)
+	}
+}
+
+func TestTransferGroupOwnership(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	if err := db.CreateGroupConversation(ctx, "group", alice, []string{bob}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TransferGroupOwnership(ctx, "group", alice, carol); !errors.Is(err, ErrUserNotInConversation) {
+		t.Errorf("transferring to a non-member returned %v, want ErrUserNotInConversation", err)
+	}
+	group, err := db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.MemberRoles[alice] != RoleOwner {
+		t.Errorf("a failed transfer left alice as %q, want owner", group.MemberRoles[alice])
+	}
+	if err := db.TransferGroupOwnership(ctx, "group", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	group, err = db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.MemberRoles[alice] != RoleAdmin || group.MemberRoles[bob] != RoleOwner {
+		t.Errorf("after the transfer roles are %v, want bob owner and alice admin", group.MemberRoles)
+	}
+}
+
+func TestConcurrentTransferGroupOwnership(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol", "dave")
+	alice, others := users[0], users[1:]
+	if err := db.CreateGroupConversation(ctx, "group", alice, others, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(others))
+	for _, to := range others {
+		wg.Add(1)
+		go func(to string) {
+			defer wg.Done()
+			errs <- db.TransferGroupOwnership(ctx, "group", alice, to)
+		}(to)
+	}
+	wg.Wait()
+	close(errs)
+	var transferred int
+	for err := range errs {
+		if err == nil {
+			transferred++
+		} else if !errors.Is(err, ErrInsufficientGroupRole) {
+			t.Error(err)
+		}
+	}
+	group, err := db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners int
+	for _, role := range group.MemberRoles {
+		if role == RoleOwner {
+			owners++
+		}
+	}
+	if transferred != 1 || owners != 1 {
+		t.Errorf("%d transfers succeeded leaving roles %v, want exactly one owner", transferred, group.MemberRoles)
+	}
+}
+
+func TestGroupRoleChecks(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := users[0], users[1], users[2], users[3]
+	if err := db.CreateGroupConversation(ctx, "group", alice, []string{bob, carol, dave}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMemberRole(ctx, "group", alice, bob, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMemberRole(ctx, "group", bob, carol, RoleAdmin); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("an admin assigning roles returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.SetMemberRole(ctx, "group", alice, alice, RoleMember); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("demoting the owner returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.RemoveGroupMember(ctx, "group", carol, dave); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("a member removing another returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.RemoveGroupMember(ctx, "group", bob, alice); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("an admin removing the owner returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.RemoveGroupMember(ctx, "group", bob, dave); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveGroupMember(ctx, "group", bob, dave); !errors.Is(err, ErrUserNotInConversation) {
+		t.Errorf("removing a former member returned %v, want ErrUserNotInConversation", err)
+	}
+
+	// Once ownership has moved on, the previous owner's checks made
+	// before the transfer no longer authorize anything.
+	if err := db.TransferGroupOwnership(ctx, "group", alice, carol); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TransferGroupOwnership(ctx, "group", alice, bob); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("transferring again returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.SetMemberRole(ctx, "group", alice, bob, RoleMember); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("the previous owner assigning roles returned %v, want ErrInsufficientGroupRole", err)
+	}
+	if err := db.RemoveGroupMember(ctx, "group", alice, bob); !errors.Is(err, ErrInsufficientGroupRole) {
+		t.Errorf("the previous owner removing an admin returned %v, want ErrInsufficientGroupRole", err)
+	}
+}
+
+func TestUpdateGroupPhoto(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	first, err := db.CreateMedia(ctx, "first", "image/png", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateMedia(ctx, "second", "image/png", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateGroupConversation(ctx, "group", users[0], []string{users[1]}, "friends", first.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateGroupPhoto(ctx, "missing", second.Id); !errors.Is(err, ErrGroupDoesNotExist) {
+		t.Errorf("updating a missing group returned %v, want ErrGroupDoesNotExist", err)
+	}
+	if err := db.UpdateGroupPhoto(ctx, "group", second.Id); err != nil {
+		t.Fatal(err)
+	}
+	group, err := db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.ConversationPhotoId != second.Id {
+		t.Errorf("group photo is %q, want %q", group.ConversationPhotoId, second.Id)
+	}
+	if _, err := db.GetMedia(ctx, first.Id); !errors.Is(err, ErrMediaDoesNotExist) {
+		t.Errorf("fetching the replaced photo returned %v, want ErrMediaDoesNotExist", err)
+	}
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (db *appdbimpl) CreateMedia(ctx context.Context, mediaID, contentType string, data []byte) (_ Media, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	sum := sha256.Sum256(data)
+	media := Media{
+		Id:          mediaID,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Sha256:      hex.EncodeToString(sum[:]),
+		Data:        data,
+		CreatedAt:   time.Now().Format(time.RFC3339),
+	}
+	unlock := db.lockContent(media.Sha256)
+	defer unlock()
+	if err := db.blobs.Put(ctx, media.Sha256, data); err != nil {
+		return Media{}, fmt.Errorf("error storing media content: %w", err)
+	}
+	_, err = db.c.ExecContext(ctx, `
+		INSERT INTO media (id, contentType, size, sha256, createdAt)
+		VALUES (?, ?, ?, ?, ?)
+	`, media.Id, media.ContentType, media.Size, media.Sha256, media.CreatedAt)
+	if err != nil {
+		return Media{}, fmt.Errorf("error saving media: %w", err)
+	}
+	return media, nil
+}
+
+// GetMedia returns the metadata of a media resource; its content is loaded
+// separately with GetMediaData.
+func (db *appdbimpl) GetMedia(ctx context.Context, mediaID string) (_ Media, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var media Media
+	err = db.c.QueryRowContext(ctx, `
+		SELECT id, contentType, size, sha256, createdAt
+		FROM media
+		WHERE id = ?
+	`, mediaID).Scan(&media.Id, &media.ContentType, &media.Size, &media.Sha256, &media.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Media{}, ErrMediaDoesNotExist
+	}
+	if err != nil {
+		return Media{}, fmt.Errorf("error fetching media: %w", err)
+	}
+	return media, nil
+}
+
+func (db *appdbimpl) GetMediaData(ctx context.Context, media Media) (_ []byte, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	data, err := db.blobs.Get(ctx, media.Sha256)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching media content: %w", err)
+	}
+	return data, nil
+}
+
+func (db *appdbimpl) CanUserAccessMedia(ctx context.Context, mediaID, userID string) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var allowed bool
+	err = db.c.QueryRowContext(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM users WHERE photoId = ?)
+			OR EXISTS(
+				SELECT 1
+				FROM conversations c
+				JOIN conversation_members cm ON c.id = cm.conversationId
+				WHERE c.photoId = ? AND cm.userId = ?
+			)
+			OR EXISTS(
+				SELECT 1
+				FROM messages m
+				JOIN conversation_members cm ON m.conversationId = cm.conversationId
+				WHERE m.attachmentId = ? AND cm.userId = ?
+			)
+	`, mediaID, mediaID, userID, mediaID, userID).Scan(&allowed)
+	if err != nil {
+		return false, fmt.Errorf("error checking media access: %w", err)
+	}
+	return allowed, nil
+}
+
+func (db *appdbimpl) ListMediaHashes(ctx context.Context) (_ []string, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `SELECT DISTINCT sha256 FROM media`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing media: %w", err)
+	}
+	defer rows.Close()
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("error scanning media hash: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating media: %w", err)
+	}
+	return hashes, nil
+}
+
+// DeleteMediaIfUnused deletes media that nothing references, such as media
+// stored for a message or group that then failed to be created.
+func (db *appdbimpl) DeleteMediaIfUnused(ctx context.Context, mediaID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	return db.deleteMediaIfUnused(ctx, mediaID)
+}
+
+// lockContent locks the blob with the given hash against concurrent
+// stores and deletions within this process. CreateMedia holds it from
+// storing the blob until its row is inserted, so a blob found unused under
+// the lock cannot gain a media row before it is deleted.
+func (db *appdbimpl) lockContent(hash string) func() {
+	var stripe byte
+	if hash != "" {
+		stripe = hash[0]
+	}
+	mu := &db.contentLocks[int(stripe)%len(db.contentLocks)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (db *appdbimpl) deleteMediaIfUnused(ctx context.Context, mediaID string) error {
+	if mediaID == "" {
+		return nil
+	}
+	var hash string
+	var deleted bool
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT sha256 FROM media WHERE id = ?`, mediaID).Scan(&hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error fetching media: %w", err)
+		}
+		res, err := tx.ExecContext(ctx, `
+			DELETE FROM media
+			WHERE id = ?
+			  AND NOT EXISTS(SELECT 1 FROM users WHERE photoId = ?)
+			  AND NOT EXISTS(SELECT 1 FROM conversations WHERE photoId = ?)
+			  AND NOT EXISTS(SELECT 1 FROM messages WHERE attachmentId = ?)
+		`, mediaID, mediaID, mediaID, mediaID)
+		if err != nil {
+			return fmt.Errorf("error deleting unused media: %w", err)
+		}
+		affected, err := res.RowsAffected()
+		deleted = affected > 0
+		return err
+	})
+	if err != nil || !deleted {
+		return err
+	}
+	// Content is shared between media with identical bytes, so the blob
+	// can only go once the last media pointing at it is gone. The blob
+	// store may write through another connection, so this happens after
+	// the commit, under the content lock.
+	unlock := db.lockContent(hash)
+	defer unlock()
+	var shared bool
+	err = db.c.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM media WHERE sha256 = ?)`, hash).Scan(&shared)
+	if err != nil {
+		return fmt.Errorf("error checking shared media content: %w", err)
+	}
+	if shared {
+		return nil
+	}
+	return db.blobs.Delete(ctx, hash)
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tassdam/wasa/service/blobstore"
+)
+
+// slowPutStore widens the window between storing a blob and inserting the
+// media row that references it.
+type slowPutStore struct {
+	blobstore.BlobStore
+}
+
+func (s slowPutStore) Put(ctx context.Context, key string, data []byte) error {
+	err := s.BlobStore.Put(ctx, key, data)
+	time.Sleep(5 * time.Millisecond)
+	return err
+}
+
+// TestConcurrentMediaReuse replaces a photo while media with the same
+// content is being created: the new media must keep its content.
+func TestConcurrentMediaReuse(t *testing.T) {
+	db := newTestDatabase(t)
+	db.blobs = slowPutStore{db.blobs}
+	ctx := context.Background()
+	user := createTestUsers(t, db, "alice")[0]
+	for i := 0; i < 20; i++ {
+		content := []byte(fmt.Sprintf("photo %d", i))
+		old, err := db.CreateMedia(ctx, fmt.Sprintf("old-%d", i), "image/png", content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.UpdateUserPhoto(ctx, user, old.Id); err != nil {
+			t.Fatal(err)
+		}
+		replacement, err := db.CreateMedia(ctx, fmt.Sprintf("replacement-%d", i), "image/png", []byte("replacement"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		var reused Media
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := db.UpdateUserPhoto(ctx, user, replacement.Id); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var err error
+			if reused, err = db.CreateMedia(ctx, fmt.Sprintf("reused-%d", i), "image/png", content); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+		if _, err := db.GetMediaData(ctx, reused); err != nil {
+			t.Fatalf("round %d: content of media created during the replacement: %v", i, err)
+		}
+	}
+}
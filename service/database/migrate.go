@@ -0,0 +1,461 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/tassdam/wasa/service/blobstore"
+)
+
+var ErrDatabaseTooNew = errors.New("Database schema is newer than this binary")
+var ErrSchemaNotMigrated = errors.New("Database schema is not up to date")
+var ErrUnknownSchema = errors.New("Database schema is not recognized")
+
+//go:embed migrations/*.sql
+var migrationScripts embed.FS
+
+// unversionedSchemaVersion is the schema that New created before schema
+// versions were recorded; databases from that time are adopted at it.
+const unversionedSchemaVersion = 5
+
+// adoptedSchemas lists, for each version an unversioned database can be
+// adopted at, the columns of every table that version has. Databases
+// missing any of them are refused rather than migrated from a wrong
+// starting point.
+var adoptedSchemas = map[int]map[string][]string{
+	1: {
+		"users":                {"id", "name", "photo"},
+		"conversations":        {"id", "name", "type", "created_at", "conversationPhoto"},
+		"conversation_members": {"conversationId", "userId"},
+		"messages":             {"id", "conversationId", "senderId", "content", "timestamp", "attachment", "replyTo"},
+		"comments":             {"id", "messageId", "authorId"},
+		"read_receipts":        {"messageId", "userId", "deliveredAt", "readAt"},
+	},
+	unversionedSchemaVersion: {
+		"users":                {"id", "name", "photoId", "presenceVisible"},
+		"conversations":        {"id", "name", "type", "created_at", "photoId"},
+		"conversation_members": {"conversationId", "userId", "role"},
+		"messages": {"id", "conversationId", "senderId", "type", "content", "timestamp", "attachmentId",
+			"replyTo", "isReply", "forwardedFromMessageId", "forwardedFromUserId", "isForward", "editedAt", "deletedAt"},
+		"media":            {"id", "contentType", "size", "sha256", "createdAt"},
+		"sessions":         {"token", "userId", "createdAt", "expiresAt"},
+		"message_edits":    {"messageId", "revision", "content", "createdAt"},
+		"hidden_messages":  {"messageId", "userId", "hiddenAt"},
+		"pinned_messages":  {"conversationId", "messageId", "pinnedBy", "pinnedAt"},
+		"starred_messages": {"userId", "messageId", "conversationId", "starredAt"},
+		"reactions":        {"messageId", "userId", "emoji", "createdAt"},
+		"read_receipts":    {"messageId", "userId", "deliveredAt", "readAt"},
+	},
+}
+
+// migration upgrades the schema to version. It runs script, or prepare
+// outside of the transaction followed by apply inside it for steps that
+// cannot be written in SQL. A buildDependent migration has a different name
+// in each build variant and is applied again when the database was migrated
+// by a build of another variant.
+type migration struct {
+	version        int
+	name           string
+	script         string
+	prepare        func(ctx context.Context, conn *sql.Conn, blobs blobstore.BlobStore) error
+	apply          func(ctx context.Context, tx *sql.Tx) error
+	buildDependent bool
+}
+
+// blobsTable holds the content of the SQLite blob store. The store used to
+// create it on its own, so it may predate migration 7.
+const blobsTable = `CREATE TABLE IF NOT EXISTS blobs (
+	key TEXT NOT NULL PRIMARY KEY,
+	data BLOB NOT NULL
+);`
+
+var codeMigrations = []migration{
+	{version: 4, name: "move_blobs_to_media", prepare: storeLegacyBlobs, apply: moveLegacyBlobsToMedia},
+	{version: 7, name: "blobs", script: blobsTable},
+	searchIndexMigration(),
+}
+
+// Migrate brings the schema up to date, applying each pending migration in
+// its own transaction. It returns the versions before and after.
+func Migrate(db *sql.DB, blobs blobstore.BlobStore) (int, int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	latest := len(migrations)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error acquiring connection for migrations: %w", err)
+	}
+	defer conn.Close()
+	// Rebuilding a table drops it, which must not cascade to the rows that
+	// reference it. Foreign keys are checked before each commit instead.
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}()
+	from, err := schemaVersion(ctx, conn, migrations)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > latest {
+		return from, from, fmt.Errorf("%w: database is at version %d, this binary supports up to %d", ErrDatabaseTooNew, from, latest)
+	}
+	recorded, err := recordedMigrations(ctx, conn)
+	if err != nil {
+		return from, from, err
+	}
+	for _, m := range migrations[:from] {
+		if !m.buildDependent || recorded[m.version] == m.name {
+			continue
+		}
+		if err := applyMigration(ctx, conn, blobs, m); err != nil {
+			return from, from, fmt.Errorf("error applying migration %04d_%s: %w", m.version, m.name, err)
+		}
+	}
+	current := from
+	for _, m := range migrations[current:] {
+		if err := applyMigration(ctx, conn, blobs, m); err != nil {
+			return from, current, fmt.Errorf("error applying migration %04d_%s: %w", m.version, m.name, err)
+		}
+		current = m.version
+	}
+	return from, current, nil
+}
+
+// checkSchema reports ErrSchemaNotMigrated unless every migration of this
+// build has been applied to db.
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	recorded, err := recordedMigrations(ctx, db)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSchemaNotMigrated, err)
+	}
+	for _, m := range migrations {
+		if recorded[m.version] != m.name {
+			return fmt.Errorf("%w: migration %04d_%s has not been applied", ErrSchemaNotMigrated, m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// recordedMigrations returns the names of the applied migrations by version.
+func recordedMigrations(ctx context.Context, q queryer) (map[int]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT version, name FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema version: %w", err)
+	}
+	defer rows.Close()
+	recorded := map[int]string{}
+	for rows.Next() {
+		var version int
+		var name string
+		if err := rows.Scan(&version, &name); err != nil {
+			return nil, err
+		}
+		recorded[version] = name
+	}
+	return recorded, rows.Err()
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationScripts, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error listing migrations: %w", err)
+	}
+	migrations := append([]migration{}, codeMigrations...)
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSuffix(entry.Name(), ".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		script, err := migrationScripts.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %q: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, migration{version: version, name: parts[1], script: string(script)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s is out of sequence", m.version, m.name)
+		}
+	}
+	return migrations, nil
+}
+
+// schemaVersion returns the version recorded in schema_version, creating
+// the table first. Databases without it are adopted at the version their
+// shape matches: the baseline if users still carries photo BLOBs, the
+// last unversioned schema otherwise. A database lacking columns of the
+// version it matches is refused with ErrUnknownSchema.
+func schemaVersion(ctx context.Context, conn *sql.Conn, migrations []migration) (int, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')
+	`).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("error checking schema version: %w", err)
+	}
+	if exists {
+		var version int
+		err := conn.QueryRowContext(ctx, `SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&version)
+		if err != nil {
+			return 0, fmt.Errorf("error reading schema version: %w", err)
+		}
+		return version, nil
+	}
+	var hasUsers, hasPhotoBlobs bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'users'),
+			EXISTS(SELECT 1 FROM pragma_table_info('users') WHERE name = 'photo')
+	`).Scan(&hasUsers, &hasPhotoBlobs)
+	if err != nil {
+		return 0, fmt.Errorf("error inspecting unversioned schema: %w", err)
+	}
+	version := 0
+	if hasPhotoBlobs {
+		version = 1
+	} else if hasUsers {
+		version = unversionedSchemaVersion
+	}
+	if err := checkAdoptedSchema(ctx, conn, version); err != nil {
+		return 0, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error starting schema version setup: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	_, err = tx.ExecContext(ctx, `CREATE TABLE schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		appliedAt TEXT NOT NULL
+	);`)
+	if err != nil {
+		return 0, fmt.Errorf("error creating schema_version table: %w", err)
+	}
+	for _, m := range migrations[:version] {
+		if err := recordMigration(ctx, tx, m); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing schema version setup: %w", err)
+	}
+	return version, nil
+}
+
+// checkAdoptedSchema reports ErrUnknownSchema unless the database has every
+// column of the schema it is about to be adopted at.
+func checkAdoptedSchema(ctx context.Context, conn *sql.Conn, version int) error {
+	tables := make([]string, 0, len(adoptedSchemas[version]))
+	for table := range adoptedSchemas[version] {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		rows, err := conn.QueryContext(ctx, `SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			return fmt.Errorf("error inspecting unversioned schema: %w", err)
+		}
+		columns := map[string]bool{}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return err
+			}
+			columns[column] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error inspecting unversioned schema: %w", err)
+		}
+		for _, column := range adoptedSchemas[version][table] {
+			if !columns[column] {
+				return fmt.Errorf("%w: unversioned database looks like version %d but %s.%s is missing", ErrUnknownSchema, version, table, column)
+			}
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, blobs blobstore.BlobStore, m migration) error {
+	if m.prepare != nil {
+		if err := m.prepare(ctx, conn, blobs); err != nil {
+			return err
+		}
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting migration: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if m.script != "" {
+		if _, err := tx.ExecContext(ctx, m.script); err != nil {
+			return err
+		}
+	}
+	if m.apply != nil {
+		if err := m.apply(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if err := checkForeignKeys(ctx, tx); err != nil {
+		return err
+	}
+	if err := recordMigration(ctx, tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func recordMigration(ctx context.Context, tx *sql.Tx, m migration) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO schema_version (version, name, appliedAt) VALUES (?, ?, ?)
+		ON CONFLICT (version) DO UPDATE SET name = excluded.name, appliedAt = excluded.appliedAt
+	`, m.version, m.name, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("error recording schema version: %w", err)
+	}
+	return nil
+}
+
+func checkForeignKeys(ctx context.Context, tx *sql.Tx) error {
+	var table, parent string
+	var rowID sql.NullInt64
+	var fkID int
+	err := tx.QueryRowContext(ctx, `PRAGMA foreign_key_check`).Scan(&table, &rowID, &parent, &fkID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error checking foreign keys: %w", err)
+	}
+	return fmt.Errorf("row %d of %s references a missing %s", rowID.Int64, table, parent)
+}
+
+// legacyBlobColumns lists the BLOB columns of the baseline schema and the
+// media reference replacing each of them.
+var legacyBlobColumns = []struct {
+	table, blob, ref string
+}{
+	{"users", "photo", "photoId"},
+	{"conversations", "conversationPhoto", "photoId"},
+	{"messages", "attachment", "attachmentId"},
+}
+
+// storeLegacyBlobs copies the BLOB column contents to the blob store. It
+// runs before the migration transaction because the SQLite blob store
+// writes through another connection; Put is idempotent, so a failed
+// migration can simply be retried.
+func storeLegacyBlobs(ctx context.Context, conn *sql.Conn, blobs blobstore.BlobStore) error {
+	// The SQLite blob store needs the table that migration 7 creates.
+	if _, err := conn.ExecContext(ctx, blobsTable); err != nil {
+		return fmt.Errorf("error creating blobs table: %w", err)
+	}
+	for _, col := range legacyBlobColumns {
+		ids, err := legacyBlobRows(ctx, conn, col.table, col.blob)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			var data []byte
+			err := conn.QueryRowContext(ctx, `SELECT `+col.blob+` FROM `+col.table+` WHERE id = ?`, id).Scan(&data)
+			if err != nil {
+				return fmt.Errorf("error reading %s.%s: %w", col.table, col.blob, err)
+			}
+			sum := sha256.Sum256(data)
+			if err := blobs.Put(ctx, hex.EncodeToString(sum[:]), data); err != nil {
+				return fmt.Errorf("error storing %s.%s: %w", col.table, col.blob, err)
+			}
+		}
+	}
+	return nil
+}
+
+// moveLegacyBlobsToMedia creates a media row for every stored BLOB, points
+// the new reference column at it and drops the BLOB column.
+func moveLegacyBlobsToMedia(ctx context.Context, tx *sql.Tx) error {
+	createdAt := time.Now().Format(time.RFC3339)
+	for _, col := range legacyBlobColumns {
+		ids, err := legacyBlobRows(ctx, tx, col.table, col.blob)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			var data []byte
+			err := tx.QueryRowContext(ctx, `SELECT `+col.blob+` FROM `+col.table+` WHERE id = ?`, id).Scan(&data)
+			if err != nil {
+				return fmt.Errorf("error reading %s.%s: %w", col.table, col.blob, err)
+			}
+			mediaID, err := uuid.NewV4()
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO media (id, contentType, size, sha256, createdAt)
+				VALUES (?, ?, ?, ?, ?)
+			`, mediaID.String(), http.DetectContentType(data), len(data), hex.EncodeToString(sum[:]), createdAt)
+			if err != nil {
+				return fmt.Errorf("error saving media: %w", err)
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE `+col.table+` SET `+col.ref+` = ? WHERE id = ?`, mediaID.String(), id)
+			if err != nil {
+				return fmt.Errorf("error linking %s.%s: %w", col.table, col.ref, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE `+col.table+` DROP COLUMN `+col.blob); err != nil {
+			return fmt.Errorf("error dropping %s.%s: %w", col.table, col.blob, err)
+		}
+	}
+	return nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func legacyBlobRows(ctx context.Context, q queryer, table, blob string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `SELECT id FROM `+table+` WHERE length(`+blob+`) > 0`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s.%s: %w", table, blob, err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
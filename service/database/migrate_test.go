@@ -0,0 +1,268 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/tassdam/wasa/service/blobstore"
+)
+
+func TestNewRequiresMigratedSchema(t *testing.T) {
+	conn, err := sql.Open("sqlite3", DSN(filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	blobs, err := blobstore.NewSQLite(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(conn, blobs, 0); !errors.Is(err, ErrSchemaNotMigrated) {
+		t.Fatalf("New on an empty database returned %v, want ErrSchemaNotMigrated", err)
+	}
+	from, to, err := Migrate(conn, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 0 || to != len(migrations) {
+		t.Errorf("migrated from %d to %d, want from 0 to the latest version", from, to)
+	}
+	if _, err := New(conn, blobs, 0); err != nil {
+		t.Fatal(err)
+	}
+	if from, to, err := Migrate(conn, blobs); err != nil || from != to {
+		t.Errorf("migrating again went from %d to %d (%v), want nothing to do", from, to, err)
+	}
+}
+
+// TestSearchIndexFollowsBuild simulates a database last migrated by a build
+// of the other variant: the search index migration must be applied again.
+func TestSearchIndexFollowsBuild(t *testing.T) {
+	db := newTestDatabase(t)
+	index := searchIndexMigration()
+	other := "search_index_fts5"
+	stale := `CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN SELECT 1; END`
+	if FullTextSearch {
+		other = "search_index_disabled"
+		stale = `DROP TRIGGER messages_fts_insert`
+	}
+	if _, err := db.c.Exec(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.c.Exec(`UPDATE schema_version SET name = ? WHERE version = ?`, other, index.version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(db.c, db.blobs, 0); !errors.Is(err, ErrSchemaNotMigrated) {
+		t.Errorf("New after switching builds returned %v, want ErrSchemaNotMigrated", err)
+	}
+	if _, _, err := Migrate(db.c, db.blobs); err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	var hasTrigger bool
+	err := db.c.QueryRow(`
+		SELECT name, EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = 'messages_fts_insert')
+		FROM schema_version WHERE version = ?
+	`, index.version).Scan(&name, &hasTrigger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != index.name {
+		t.Errorf("search index migration is recorded as %q, want %q", name, index.name)
+	}
+	if hasTrigger != FullTextSearch {
+		t.Errorf("search index trigger present: %v, want %v", hasTrigger, FullTextSearch)
+	}
+}
+
+// newBaselineDatabase opens a database with the schema of the first
+// release, as created before migrations were recorded, and runs seed on it.
+func newBaselineDatabase(t *testing.T, seed string) (*sql.DB, blobstore.BlobStore) {
+	t.Helper()
+	conn, err := sql.Open("sqlite3", DSN(filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	baseline, err := migrationScripts.ReadFile("migrations/0001_baseline.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(string(baseline)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(seed); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := blobstore.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, blobs
+}
+
+func TestMigratePopulatedBaseline(t *testing.T) {
+	ctx := context.Background()
+	png := "X'89504E470D0A1A0A0000000D49484452'"
+	conn, blobs := newBaselineDatabase(t, `
+		INSERT INTO users (id, name, photo) VALUES ('alice', 'alice', `+png+`), ('bob', 'bob', NULL);
+		INSERT INTO conversations (id, name, type, created_at, conversationPhoto) VALUES
+			('direct', '', 'direct', '2024-01-01T00:00:00Z', NULL),
+			('group', 'friends', 'group', '2024-01-01T00:00:00Z', `+png+`);
+		INSERT INTO conversation_members (conversationId, userId) VALUES
+			('direct', 'alice'), ('direct', 'bob'), ('group', 'alice'), ('group', 'bob');
+		INSERT INTO messages (id, conversationId, senderId, content, timestamp, attachment, replyTo) VALUES
+			('hello', 'direct', 'alice', 'hello', '2024-01-01T00:00:01Z', `+png+`, NULL),
+			('reply', 'direct', 'bob', 'hi', '2024-01-01T00:00:02Z', NULL, 'hello'),
+			('known', 'group', 'alice', '<strong>Forwarded from bob:</strong> hello', '2024-01-01T00:00:03Z', NULL, NULL),
+			('unknown', 'group', 'alice', '<strong>Forwarded from carol:</strong> hi', '2024-01-01T00:00:04Z', NULL, NULL);
+		INSERT INTO comments (id, messageId, authorId) VALUES ('like', 'hello', 'bob');
+		INSERT INTO read_receipts (messageId, userId, deliveredAt, readAt) VALUES
+			('hello', 'bob', '2024-01-01T00:00:05Z', '2024-01-01T00:00:06Z');
+	`)
+	if from, _, err := Migrate(conn, blobs); err != nil || from != 1 {
+		t.Fatalf("migrating the baseline started from %d (%v), want 1", from, err)
+	}
+	db, err := New(conn, blobs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPNG := func(what, mediaID string) {
+		t.Helper()
+		media, err := db.GetMedia(ctx, mediaID)
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		data, err := db.GetMediaData(ctx, media)
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if media.ContentType != "image/png" || len(data) != 16 {
+			t.Errorf("%s became %d bytes of %s, want the 16 byte PNG", what, len(data), media.ContentType)
+		}
+	}
+
+	alice, err := db.GetUsersPhoto(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPNG("user photo", alice.PhotoId)
+	group, err := db.GetGroupInfo(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPNG("group photo", group.ConversationPhotoId)
+	if group.MemberRoles["alice"] != RoleOwner {
+		t.Errorf("group roles are %v, want the first member as owner", group.MemberRoles)
+	}
+
+	hello, err := db.GetMessage(ctx, "hello", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPNG("attachment", hello.AttachmentId)
+	messages, _, err := db.GetMessagesForConversation(ctx, "direct", "alice", MessagePage{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("direct conversation has %d messages after migrating, want 2", len(messages))
+	}
+	if reply := messages[1]; reply.ReplyTo != "hello" || reply.ReplyContent != "hello" {
+		t.Errorf("reply migrated to %+v, want a reply to hello", reply)
+	}
+	reactions, err := db.GetReactions(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 1 || reactions[0].Emoji != "❤️" || reactions[0].Users[0].Id != "bob" {
+		t.Errorf("comment migrated to reactions %+v, want a heart from bob", reactions)
+	}
+	receipts, err := db.GetMessageReceipts(ctx, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ReadAt != "2024-01-01T00:00:06Z" {
+		t.Errorf("receipts migrated to %+v, want bob's read receipt", receipts)
+	}
+
+	known, err := db.GetMessage(ctx, "known", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if known.Content != "hello" || !known.Forwarded || known.ForwardedFromUserId != "bob" || known.ForwardedFromName != "bob" {
+		t.Errorf("forward from a known user migrated to %+v, want hello forwarded from bob", known)
+	}
+	unknown, err := db.GetMessage(ctx, "unknown", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown.Content != "<strong>Forwarded from carol:</strong> hi" || unknown.Forwarded {
+		t.Errorf("forward from an unknown name migrated to %+v, want the content kept as it was", unknown)
+	}
+}
+
+func TestMigrateDatabaseTooNew(t *testing.T) {
+	db := newTestDatabase(t)
+	_, err := db.c.Exec(`INSERT INTO schema_version (version, name, appliedAt) SELECT MAX(version) + 1, 'future', '' FROM schema_version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Migrate(db.c, db.blobs); !errors.Is(err, ErrDatabaseTooNew) {
+		t.Errorf("migrating a newer database returned %v, want ErrDatabaseTooNew", err)
+	}
+}
+
+func TestAdoptUnversionedSchema(t *testing.T) {
+	ctx := context.Background()
+	conn, blobs := newBaselineDatabase(t, "")
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bring the baseline to the last unversioned schema and forget the
+	// versions, as New used to leave it.
+	if _, err := c.ExecContext(ctx, `CREATE TABLE schema_version (version INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, appliedAt TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[1:unversionedSchemaVersion] {
+		if err := applyMigration(ctx, c, blobs, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.ExecContext(ctx, `DROP TABLE schema_version`); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if from, _, err := Migrate(conn, blobs); err != nil || from != unversionedSchemaVersion {
+		t.Fatalf("migrating an unversioned database started from %d (%v), want %d", from, err, unversionedSchemaVersion)
+	}
+	if _, err := New(conn, blobs, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	other, blobs := newBaselineDatabase(t, `ALTER TABLE users DROP COLUMN photo`)
+	if _, _, err := Migrate(other, blobs); !errors.Is(err, ErrUnknownSchema) {
+		t.Errorf("migrating a database of unknown shape returned %v, want ErrUnknownSchema", err)
+	}
+	var versioned bool
+	if err := other.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name = 'schema_version')`).Scan(&versioned); err != nil {
+		t.Fatal(err)
+	}
+	if versioned {
+		t.Error("a database of unknown shape was adopted")
+	}
+}
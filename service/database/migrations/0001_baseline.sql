@@ -0,0 +1,54 @@
+-- The schema of the first release, which databases created before
+-- versioned migrations may still have.
+CREATE TABLE users (
+	id TEXT NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	photo BLOB
+);
+
+CREATE TABLE conversations (
+	id TEXT NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	conversationPhoto BLOB
+);
+
+CREATE TABLE conversation_members (
+	conversationId TEXT NOT NULL,
+	userId TEXT NOT NULL,
+	FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY(conversationId, userId)
+);
+
+CREATE TABLE messages (
+	id TEXT NOT NULL PRIMARY KEY,
+	conversationId TEXT NOT NULL,
+	senderId TEXT NOT NULL,
+	content TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	attachment BLOB,
+	replyTo TEXT,
+	FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+	FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE comments (
+	id TEXT NOT NULL PRIMARY KEY,
+	messageId TEXT NOT NULL,
+	authorId TEXT NOT NULL,
+	UNIQUE(messageId, authorId),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (authorId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE read_receipts (
+	messageId TEXT NOT NULL,
+	userId TEXT NOT NULL,
+	deliveredAt TEXT NOT NULL,
+	readAt TEXT,
+	PRIMARY KEY (messageId, userId),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,15 @@
+-- The first release did not enforce foreign keys on every connection, so
+-- its databases may hold rows pointing at deleted users, conversations or
+-- messages. Every later migration is checked against foreign keys.
+DELETE FROM conversation_members
+WHERE conversationId NOT IN (SELECT id FROM conversations)
+   OR userId NOT IN (SELECT id FROM users);
+DELETE FROM messages
+WHERE conversationId NOT IN (SELECT id FROM conversations)
+   OR senderId NOT IN (SELECT id FROM users);
+DELETE FROM comments
+WHERE messageId NOT IN (SELECT id FROM messages)
+   OR authorId NOT IN (SELECT id FROM users);
+DELETE FROM read_receipts
+WHERE messageId NOT IN (SELECT id FROM messages)
+   OR userId NOT IN (SELECT id FROM users);
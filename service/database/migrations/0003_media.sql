@@ -0,0 +1,15 @@
+-- Photos and attachments become media resources whose content lives in
+-- the blob store. Migration 4 moves the existing BLOB columns over.
+CREATE TABLE media (
+	id TEXT NOT NULL PRIMARY KEY,
+	contentType TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	sha256 TEXT NOT NULL,
+	createdAt TEXT NOT NULL
+);
+
+CREATE INDEX idx_media_sha256 ON media (sha256);
+
+ALTER TABLE users ADD COLUMN photoId TEXT REFERENCES media(id) ON DELETE SET NULL;
+ALTER TABLE conversations ADD COLUMN photoId TEXT REFERENCES media(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN attachmentId TEXT REFERENCES media(id) ON DELETE SET NULL;
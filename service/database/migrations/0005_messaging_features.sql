@@ -0,0 +1,157 @@
+-- Sessions, group roles, presence, and the message features built on top
+-- of the media schema: replies that survive their parent, edits, deletion,
+-- reactions, receipts, pins, stars and forwarding metadata.
+
+ALTER TABLE users ADD COLUMN presenceVisible INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE conversation_members
+ADD COLUMN role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member'));
+
+-- Groups did not record their creator; the earliest member becomes owner.
+UPDATE conversation_members SET role = 'owner'
+WHERE rowid IN (
+	SELECT MIN(cm.rowid)
+	FROM conversation_members cm
+	JOIN conversations c ON c.id = cm.conversationId
+	WHERE c.type = 'group'
+	GROUP BY cm.conversationId
+);
+
+CREATE TABLE sessions (
+	token TEXT NOT NULL PRIMARY KEY,
+	userId TEXT NOT NULL,
+	createdAt TEXT NOT NULL,
+	expiresAt TEXT NOT NULL,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE messages_new (
+	id TEXT NOT NULL PRIMARY KEY,
+	conversationId TEXT NOT NULL,
+	senderId TEXT NOT NULL,
+	type TEXT NOT NULL DEFAULT 'text' CHECK (type IN ('text', 'system')),
+	content TEXT NOT NULL,
+	timestamp TEXT NOT NULL,
+	attachmentId TEXT,
+	replyTo TEXT,
+	isReply INTEGER NOT NULL DEFAULT 0,
+	forwardedFromMessageId TEXT,
+	forwardedFromUserId TEXT,
+	isForward INTEGER NOT NULL DEFAULT 0,
+	editedAt TEXT,
+	deletedAt TEXT,
+	FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+	FOREIGN KEY (senderId) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (replyTo) REFERENCES messages(id) ON DELETE SET NULL,
+	FOREIGN KEY (forwardedFromMessageId) REFERENCES messages(id) ON DELETE SET NULL,
+	FOREIGN KEY (forwardedFromUserId) REFERENCES users(id) ON DELETE SET NULL,
+	FOREIGN KEY (attachmentId) REFERENCES media(id) ON DELETE SET NULL
+);
+
+INSERT INTO messages_new (id, conversationId, senderId, content, timestamp, attachmentId, replyTo, isReply)
+SELECT
+	id,
+	conversationId,
+	senderId,
+	content,
+	timestamp,
+	attachmentId,
+	CASE WHEN replyTo IN (SELECT id FROM messages) THEN replyTo END,
+	IFNULL(replyTo, '') != ''
+FROM messages;
+
+DROP TABLE messages;
+ALTER TABLE messages_new RENAME TO messages;
+CREATE INDEX idx_messages_conversation_timestamp ON messages (conversationId, timestamp);
+
+-- Forwards used to be marked up in the content with a user's name. The name
+-- is resolved to forwardedFromUserId before the markup is stripped; content
+-- whose name matches no user is left as it was so the name is not lost.
+UPDATE messages
+SET forwardedFromUserId = (
+		SELECT u.id FROM users u
+		WHERE u.name = substr(content, length('<strong>Forwarded from ') + 1,
+			instr(content, ':</strong> ') - length('<strong>Forwarded from ') - 1)
+	),
+	content = substr(content, instr(content, ':</strong> ') + length(':</strong> ')),
+	isForward = 1
+WHERE content LIKE '<strong>Forwarded from %:</strong> %'
+  AND EXISTS (
+	SELECT 1 FROM users u
+	WHERE u.name = substr(content, length('<strong>Forwarded from ') + 1,
+		instr(content, ':</strong> ') - length('<strong>Forwarded from ') - 1)
+  );
+
+CREATE TABLE message_edits (
+	messageId TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	createdAt TEXT NOT NULL,
+	PRIMARY KEY (messageId, revision),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE
+);
+
+CREATE TABLE hidden_messages (
+	messageId TEXT NOT NULL,
+	userId TEXT NOT NULL,
+	hiddenAt TEXT NOT NULL,
+	PRIMARY KEY (userId, messageId),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE pinned_messages (
+	conversationId TEXT NOT NULL,
+	messageId TEXT NOT NULL,
+	pinnedBy TEXT NOT NULL,
+	pinnedAt TEXT NOT NULL,
+	PRIMARY KEY (conversationId, messageId),
+	FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE,
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (pinnedBy) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE starred_messages (
+	userId TEXT NOT NULL,
+	messageId TEXT NOT NULL,
+	conversationId TEXT NOT NULL,
+	starredAt TEXT NOT NULL,
+	PRIMARY KEY (userId, messageId),
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE,
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (conversationId) REFERENCES conversations(id) ON DELETE CASCADE
+);
+
+-- Comments were single likes; they become heart reactions.
+CREATE TABLE reactions (
+	messageId TEXT NOT NULL,
+	userId TEXT NOT NULL,
+	emoji TEXT NOT NULL,
+	createdAt TEXT NOT NULL,
+	PRIMARY KEY (messageId, userId, emoji),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO reactions (messageId, userId, emoji, createdAt)
+SELECT messageId, authorId, '❤️', strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+FROM comments;
+
+DROP TABLE comments;
+
+-- deliveredAt is now only set once a message actually reaches the user.
+CREATE TABLE read_receipts_new (
+	messageId TEXT NOT NULL,
+	userId TEXT NOT NULL,
+	deliveredAt TEXT,
+	readAt TEXT,
+	PRIMARY KEY (messageId, userId),
+	FOREIGN KEY (messageId) REFERENCES messages(id) ON DELETE CASCADE,
+	FOREIGN KEY (userId) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO read_receipts_new (messageId, userId, deliveredAt, readAt)
+SELECT messageId, userId, deliveredAt, readAt FROM read_receipts;
+
+DROP TABLE read_receipts;
+ALTER TABLE read_receipts_new RENAME TO read_receipts;
@@ -0,0 +1,5 @@
+-- Indexes for listing a user's conversations: their memberships, and the
+-- receipts of messages they have not read yet.
+CREATE INDEX idx_conversation_members_user ON conversation_members (userId, conversationId);
+
+CREATE INDEX idx_read_receipts_unread ON read_receipts (userId, messageId) WHERE readAt IS NULL;
@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PinMessage pins a message in its conversation. It reports false when the
+// message was already pinned and fails with ErrTooManyPinnedMessages once
+// the conversation holds limit pins.
+func (db *appdbimpl) PinMessage(ctx context.Context, conversationID, messageID, userID string, limit int) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var added bool
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var pinned, count int
+		err := tx.QueryRowContext(ctx, `
+			SELECT COUNT(*), IFNULL(SUM(messageId = ?), 0)
+			FROM pinned_messages
+			WHERE conversationId = ?
+		`, messageID, conversationID).Scan(&count, &pinned)
+		if err != nil {
+			return fmt.Errorf("error counting pinned messages: %w", err)
+		}
+		if pinned > 0 {
+			return nil
+		}
+		if count >= limit {
+			return ErrTooManyPinnedMessages
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO pinned_messages (conversationId, messageId, pinnedBy, pinnedAt)
+			VALUES (?, ?, ?, ?)
+		`, conversationID, messageID, userID, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("error pinning message: %w", err)
+		}
+		added = true
+		return nil
+	})
+	return added, err
+}
+
+// UnpinMessage reports whether the message was pinned.
+func (db *appdbimpl) UnpinMessage(ctx context.Context, conversationID, messageID string) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	res, err := db.c.ExecContext(ctx, `
+		DELETE FROM pinned_messages WHERE conversationId = ? AND messageId = ?
+	`, conversationID, messageID)
+	if err != nil {
+		return false, fmt.Errorf("error unpinning message: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// GetPinnedMessages returns the pins of a conversation, most recent first.
+func (db *appdbimpl) GetPinnedMessages(ctx context.Context, conversationID string) (_ []PinnedMessage, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT
+			p.pinnedBy,
+			pu.name,
+			p.pinnedAt,
+			m.id,
+			m.conversationId,
+			m.senderId,
+			su.name,
+			IFNULL(su.photoId, ''),
+			m.type,
+			m.content,
+			m.timestamp,
+			IFNULL(m.attachmentId, ''),
+			IFNULL(m.editedAt, '')
+		FROM pinned_messages p
+		JOIN messages m ON m.id = p.messageId
+		JOIN users su ON su.id = m.senderId
+		JOIN users pu ON pu.id = p.pinnedBy
+		WHERE p.conversationId = ?
+		ORDER BY p.pinnedAt DESC, p.rowid DESC
+	`, conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching pinned messages: %w", err)
+	}
+	defer rows.Close()
+	var pins []PinnedMessage
+	for rows.Next() {
+		var pin PinnedMessage
+		m := &pin.Message
+		if err := rows.Scan(
+			&pin.PinnedBy,
+			&pin.PinnedByName,
+			&pin.PinnedAt,
+			&m.Id,
+			&m.ConversationId,
+			&m.SenderId,
+			&m.SenderName,
+			&m.SenderPhotoId,
+			&m.Type,
+			&m.Content,
+			&m.Timestamp,
+			&m.AttachmentId,
+			&m.EditedAt,
+		); err != nil {
+			return nil, fmt.Errorf("error scanning pinned message: %w", err)
+		}
+		m.Edited = m.EditedAt != ""
+		pins = append(pins, pin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating pinned messages: %w", err)
+	}
+	return pins, nil
+}
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentPinMessage(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	const messages, limit = 12, 5
+	for i := 0; i < messages; i++ {
+		if _, err := db.SaveMessage(ctx, "conv", users[i%2], fmt.Sprintf("msg-%d", i), "hello", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, messages)
+	for i := 0; i < messages; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := db.PinMessage(ctx, "conv", fmt.Sprintf("msg-%d", i), users[0], limit)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	var rejected int
+	for err := range errs {
+		if errors.Is(err, ErrTooManyPinnedMessages) {
+			rejected++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	pins, err := db.GetPinnedMessages(ctx, "conv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != limit || rejected != messages-limit {
+		t.Errorf("got %d pins and %d rejections, want %d and %d", len(pins), rejected, limit, messages-limit)
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (db *appdbimpl) AddReaction(ctx context.Context, messageID, userID, emoji string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `
+		INSERT INTO reactions (messageId, userId, emoji, createdAt) VALUES (?, ?, ?, ?)
+		ON CONFLICT (messageId, userId, emoji) DO NOTHING
+	`, messageID, userID, emoji, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to insert reaction: %w", err)
+	}
+	return nil
+}
+
+func (db *appdbimpl) RemoveReaction(ctx context.Context, messageID, userID, emoji string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `
+		DELETE FROM reactions WHERE messageId = ? AND userId = ? AND emoji = ?
+	`, messageID, userID, emoji)
+	if err != nil {
+		return fmt.Errorf("failed to delete reaction: %w", err)
+	}
+	return nil
+}
+
+// ToggleReaction removes the user's reaction with this emoji if present and
+// adds it otherwise, reporting whether it was added.
+func (db *appdbimpl) ToggleReaction(ctx context.Context, messageID, userID, emoji string) (_ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var added bool
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+			DELETE FROM reactions WHERE messageId = ? AND userId = ? AND emoji = ?
+		`, messageID, userID, emoji)
+		if err != nil {
+			return fmt.Errorf("failed to delete reaction: %w", err)
+		}
+		removed, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO reactions (messageId, userId, emoji, createdAt) VALUES (?, ?, ?, ?)
+		`, messageID, userID, emoji, time.Now().Format(time.RFC3339))
+		if err != nil {
+			return fmt.Errorf("failed to insert reaction: %w", err)
+		}
+		added = true
+		return nil
+	})
+	return added, err
+}
+
+func (db *appdbimpl) GetReactions(ctx context.Context, messageID string) (_ []Reaction, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	reactions, err := db.getReactions(ctx, []string{messageID})
+	if err != nil {
+		return nil, err
+	}
+	return reactions[messageID], nil
+}
+
+// getReactions aggregates the reactions of the given messages per emoji,
+// ordered by when each emoji was first used on the message.
+func (db *appdbimpl) getReactions(ctx context.Context, messageIDs []string) (map[string][]Reaction, error) {
+	reactions := make(map[string][]Reaction, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	args := make([]interface{}, len(messageIDs))
+	for i, id := range messageIDs {
+		args[i] = id
+	}
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT r.messageId, r.emoji, u.id, u.name, IFNULL(u.photoId, '')
+		FROM reactions r
+		JOIN users u ON r.userId = u.id
+		WHERE r.messageId IN (?`+strings.Repeat(", ?", len(messageIDs)-1)+`)
+		ORDER BY r.createdAt, r.rowid`,
+		args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching reactions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID, emoji string
+		var user User
+		if err := rows.Scan(&messageID, &emoji, &user.Id, &user.Name, &user.PhotoId); err != nil {
+			return nil, fmt.Errorf("error scanning reaction: %w", err)
+		}
+		list := reactions[messageID]
+		i := 0
+		for i < len(list) && list[i].Emoji != emoji {
+			i++
+		}
+		if i == len(list) {
+			list = append(list, Reaction{Emoji: emoji})
+		}
+		list[i].Count++
+		list[i].Users = append(list[i].Users, user)
+		reactions[messageID] = list
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating reactions: %w", err)
+	}
+	return reactions, nil
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentToggleReaction(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob")
+	if err := db.CreateDirectConversation(ctx, "conv", users[0], users[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SaveMessage(ctx, "conv", users[1], "msg", "hello", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	// Every toggle either adds or removes the reaction, so after an odd
+	// number of toggles it must be present and have been added once more
+	// often than it was removed.
+	const toggles = 51
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var added int
+	for i := 0; i < toggles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.ToggleReaction(ctx, "msg", users[0], "👍")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if added != toggles/2+1 {
+		t.Errorf("reaction was added %d times in %d toggles, want %d", added, toggles, toggles/2+1)
+	}
+	reactions, err := db.GetReactions(ctx, "msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 1 || reactions[0].Count != 1 {
+		t.Errorf("got reactions %+v, want a single 👍", reactions)
+	}
+}
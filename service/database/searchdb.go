@@ -0,0 +1,327 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sentinels placed around matches by snippet(); they are replaced with
+// <mark> tags after the snippet has been HTML-escaped.
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+const fallbackSnippetRunes = 120
+
+// MessageSearch holds the parameters of a message search. Query terms are
+// separated by spaces; "quoted text" matches a phrase and a trailing * makes
+// a term match as a prefix.
+type MessageSearch struct {
+	Query          string
+	ConversationId string
+	SenderId       string
+	From           time.Time
+	To             time.Time
+	Before         string
+	Limit          int
+}
+
+// MessageSearchResult is a matching message; Snippet is HTML with the
+// matched terms wrapped in <mark> tags.
+type MessageSearchResult struct {
+	MessageId      string `json:"messageId"`
+	ConversationId string `json:"conversationId"`
+	SenderId       string `json:"senderId"`
+	SenderName     string `json:"senderName"`
+	Timestamp      string `json:"timestamp"`
+	Snippet        string `json:"snippet"`
+}
+
+type searchTerm struct {
+	text   string
+	prefix bool
+}
+
+// searchIndexMigration maintains the FTS5 index over message contents, kept
+// in sync by triggers. Builds without FTS5 drop the triggers, since they
+// could not run; the next FTS5 build then recreates them and rebuilds the
+// index.
+func searchIndexMigration() migration {
+	if !FullTextSearch {
+		return migration{version: 8, name: "search_index_disabled", apply: dropSearchIndexTriggers, buildDependent: true}
+	}
+	return migration{version: 8, name: "search_index_fts5", apply: createSearchIndex, buildDependent: true}
+}
+
+func dropSearchIndexTriggers(ctx context.Context, tx *sql.Tx) error {
+	for _, trigger := range []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"} {
+		if _, err := tx.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+trigger); err != nil {
+			return fmt.Errorf("error dropping search index trigger: %w", err)
+		}
+	}
+	return nil
+}
+
+func createSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	queries := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+			content,
+			content='messages',
+			content_rowid='rowid',
+			tokenize='unicode61 remove_diacritics 2'
+		);`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, content) VALUES (new.rowid, new.content);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+			INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+			INSERT INTO messages_fts (rowid, content) VALUES (new.rowid, new.content);
+		END;`,
+		`INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');`,
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("error creating search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// SearchMessages finds text messages visible to the user, most recent first.
+func (db *appdbimpl) SearchMessages(ctx context.Context, userID string, search MessageSearch) (_ []MessageSearchResult, _ bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	terms := parseSearchQuery(search.Query)
+	if len(terms) == 0 {
+		return nil, false, ErrInvalidSearchQuery
+	}
+	filters := []string{
+		"m.type = 'text'",
+		"m.deletedAt IS NULL",
+		"NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.messageId = m.id AND h.userId = cm.userId)",
+	}
+	args := []interface{}{userID}
+	snippet := "m.content"
+	from := "messages m"
+	if FullTextSearch {
+		snippet = "snippet(messages_fts, 0, '" + matchStart + "', '" + matchEnd + "', '…', 16)"
+		from = "messages_fts JOIN messages m ON m.rowid = messages_fts.rowid"
+		filters = append(filters, "messages_fts MATCH ?")
+		args = append(args, ftsQuery(terms))
+	} else {
+		for _, term := range terms {
+			filters = append(filters, `m.content LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escapeLike(term.text)+"%")
+		}
+	}
+	if search.ConversationId != "" {
+		filters = append(filters, "m.conversationId = ?")
+		args = append(args, search.ConversationId)
+	}
+	if search.SenderId != "" {
+		filters = append(filters, "m.senderId = ?")
+		args = append(args, search.SenderId)
+	}
+	if !search.From.IsZero() {
+		filters = append(filters, "m.timestamp >= ?")
+		args = append(args, search.From.Local().Format(time.RFC3339))
+	}
+	if !search.To.IsZero() {
+		filters = append(filters, "m.timestamp < ?")
+		args = append(args, search.To.Local().Format(time.RFC3339))
+	}
+	if search.Before != "" {
+		var cursorTimestamp string
+		var cursorRowID int64
+		err := db.c.QueryRowContext(ctx, `
+			SELECT timestamp, rowid FROM messages WHERE id = ?
+		`, search.Before).Scan(&cursorTimestamp, &cursorRowID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, ErrMessageDoesNotExist
+		} else if err != nil {
+			return nil, false, fmt.Errorf("error fetching search cursor: %w", err)
+		}
+		filters = append(filters, "(m.timestamp, m.rowid) < (?, ?)")
+		args = append(args, cursorTimestamp, cursorRowID)
+	}
+	args = append(args, search.Limit+1)
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT m.id, m.conversationId, m.senderId, u.name, m.timestamp, `+snippet+`
+		FROM `+from+`
+		JOIN conversation_members cm ON cm.conversationId = m.conversationId AND cm.userId = ?
+		JOIN users u ON u.id = m.senderId
+		WHERE `+strings.Join(filters, " AND ")+`
+		ORDER BY m.timestamp DESC, m.rowid DESC
+		LIMIT ?`,
+		args...)
+	if err != nil {
+		return nil, false, fmt.Errorf("error searching messages: %w", err)
+	}
+	defer rows.Close()
+	var results []MessageSearchResult
+	for rows.Next() {
+		var result MessageSearchResult
+		err := rows.Scan(
+			&result.MessageId,
+			&result.ConversationId,
+			&result.SenderId,
+			&result.SenderName,
+			&result.Timestamp,
+			&result.Snippet,
+		)
+		if err != nil {
+			return nil, false, fmt.Errorf("error scanning search result: %w", err)
+		}
+		if !FullTextSearch {
+			result.Snippet = fallbackSnippet(result.Snippet, terms)
+		}
+		result.Snippet = markMatches(result.Snippet)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("error iterating search results: %w", err)
+	}
+	hasMore := len(results) > search.Limit
+	if hasMore {
+		results = results[:search.Limit]
+	}
+	return results, hasMore, nil
+}
+
+// parseSearchQuery splits a query into terms; an unterminated quote runs to
+// the end of the query.
+func parseSearchQuery(query string) []searchTerm {
+	var terms []searchTerm
+	for {
+		query = strings.TrimSpace(query)
+		if query == "" {
+			return terms
+		}
+		var term searchTerm
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				term.text, query = query[1:], ""
+			} else {
+				term.text, query = query[1:end+1], query[end+2:]
+			}
+			term.text = strings.Join(strings.Fields(term.text), " ")
+		} else {
+			end := strings.IndexAny(query, " \t\n\"")
+			if end < 0 {
+				end = len(query)
+			}
+			term.text, query = query[:end], query[end:]
+			if strings.HasSuffix(term.text, "*") {
+				term.text = strings.TrimRight(term.text, "*")
+				term.prefix = true
+			}
+		}
+		if term.text != "" {
+			terms = append(terms, term)
+		}
+	}
+}
+
+// ftsQuery quotes every term so user input cannot use FTS5 operators or
+// column filters; terms are implicitly ANDed.
+func ftsQuery(terms []searchTerm) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = `"` + strings.ReplaceAll(term.text, `"`, `""`) + `"`
+		if term.prefix {
+			parts[i] += "*"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// fallbackSnippet approximates FTS5 snippets: it cuts the content around the
+// first match and surrounds matches with the sentinels. Matching ignores
+// ASCII case only, like SQLite's LIKE.
+func fallbackSnippet(content string, terms []searchTerm) string {
+	folded := asciiLower(content)
+	first := len(content)
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		needle := asciiLower(term.text)
+		for offset := 0; ; {
+			i := strings.Index(folded[offset:], needle)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			spans = append(spans, span{start, start + len(needle)})
+			if start < first {
+				first = start
+			}
+			offset = start + len(needle)
+		}
+	}
+	start, end := 0, len(content)
+	if utf8.RuneCountInString(content) > fallbackSnippetRunes {
+		start = first
+		for n := 0; start > 0 && n < fallbackSnippetRunes/4; n++ {
+			_, size := utf8.DecodeLastRuneInString(content[:start])
+			start -= size
+		}
+		end = start
+		for n := 0; end < len(content) && n < fallbackSnippetRunes; n++ {
+			_, size := utf8.DecodeRuneInString(content[end:])
+			end += size
+		}
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		opened := false
+		for _, s := range spans {
+			if s.start == i && s.end <= end {
+				b.WriteString(matchStart + content[s.start:s.end] + matchEnd)
+				i = s.end
+				opened = true
+				break
+			}
+		}
+		if !opened {
+			b.WriteByte(content[i])
+			i++
+		}
+	}
+	if end < len(content) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// asciiLower lowers ASCII letters only, so byte offsets are preserved.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+func markMatches(snippet string) string {
+	return strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>").Replace(html.EscapeString(snippet))
+}
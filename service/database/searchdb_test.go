@@ -0,0 +1,163 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []searchTerm
+	}{
+		{"hello world", []searchTerm{{text: "hello"}, {text: "world"}}},
+		{`"quick   brown" fox*`, []searchTerm{{text: "quick brown"}, {text: "fox", prefix: true}}},
+		{`  "unterminated  phrase`, []searchTerm{{text: "unterminated phrase"}}},
+		{`a"b"`, []searchTerm{{text: "a"}, {text: "b"}}},
+		{`** "" "  "`, nil},
+	}
+	for _, tt := range tests {
+		if got := parseSearchQuery(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSearchQuery(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestFTSQueryQuotesOperators(t *testing.T) {
+	tests := []struct {
+		terms []searchTerm
+		want  string
+	}{
+		{[]searchTerm{{text: "hello"}, {text: "wor", prefix: true}}, `"hello" "wor"*`},
+		{[]searchTerm{{text: `x" OR "y`}}, `"x"" OR ""y"`},
+		{[]searchTerm{{text: "content:secret"}, {text: "NEAR(a"}, {text: "-b"}, {text: "^c"}}, `"content:secret" "NEAR(a" "-b" "^c"`},
+	}
+	for _, tt := range tests {
+		if got := ftsQuery(tt.terms); got != tt.want {
+			t.Errorf("ftsQuery(%+v) = %s, want %s", tt.terms, got, tt.want)
+		}
+	}
+}
+
+func TestMarkMatchesEscapesHTML(t *testing.T) {
+	got := markMatches(`<img src=x onerror="alert(1)"> & ` + matchStart + "<b>" + matchEnd)
+	want := `&lt;img src=x onerror=&#34;alert(1)&#34;&gt; &amp; <mark>&lt;b&gt;</mark>`
+	if got != want {
+		t.Errorf("markMatches = %s, want %s", got, want)
+	}
+}
+
+func TestFallbackSnippet(t *testing.T) {
+	got := fallbackSnippet("Meet me at the CAFE, the cafe", []searchTerm{{text: "cafe"}, {text: "meet"}})
+	want := matchStart + "Meet" + matchEnd + " me at the " + matchStart + "CAFE" + matchEnd + ", the " + matchStart + "cafe" + matchEnd
+	if got != want {
+		t.Errorf("short snippet = %q, want %q", got, want)
+	}
+
+	// Long content is cut around the first match, on rune boundaries.
+	content := strings.Repeat("é", 100) + "needle" + strings.Repeat("x", 200)
+	got = fallbackSnippet(content, []searchTerm{{text: "needle"}})
+	before := fallbackSnippetRunes / 4
+	want = "…" + strings.Repeat("é", before) + matchStart + "needle" + matchEnd +
+		strings.Repeat("x", fallbackSnippetRunes-before-len("needle")) + "…"
+	if got != want {
+		t.Errorf("long snippet = %q, want %q", got, want)
+	}
+	if !utf8.ValidString(got) {
+		t.Error("long snippet is not valid UTF-8")
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol")
+	alice, bob, carol := users[0], users[1], users[2]
+	if err := db.CreateGroupConversation(ctx, "group", alice, []string{bob}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateDirectConversation(ctx, "direct", bob, carol); err != nil {
+		t.Fatal(err)
+	}
+	send := func(conversationID, senderID, messageID, content string) {
+		t.Helper()
+		if _, err := db.SaveMessage(ctx, conversationID, senderID, messageID, content, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("group", alice, "cafe", "Let's meet at the cafe")
+	send("group", bob, "notes", "meeting notes are <b>ready</b>")
+	send("group", bob, "deleted", "meeting moved")
+	send("group", bob, "hidden", "meeting cancelled")
+	send("direct", carol, "secret", "secret meeting")
+	if err := db.DeleteMessage(ctx, "group", "deleted", bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HideMessage(ctx, "group", "hidden", alice); err != nil {
+		t.Fatal(err)
+	}
+	search := func(userID string, s MessageSearch) []string {
+		t.Helper()
+		if s.Limit == 0 {
+			s.Limit = 10
+		}
+		results, _, err := db.SearchMessages(ctx, userID, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, result := range results {
+			ids = append(ids, result.MessageId)
+		}
+		return ids
+	}
+
+	results, _, err := db.SearchMessages(ctx, alice, MessageSearch{Query: "meeting", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].MessageId != "notes" || results[0].SenderName != "bob" {
+		t.Fatalf("alice searching meeting got %+v, want only bob's notes", results)
+	}
+	if want := "<mark>meeting</mark> notes are &lt;b&gt;ready&lt;/b&gt;"; results[0].Snippet != want {
+		t.Errorf("snippet is %s, want %s", results[0].Snippet, want)
+	}
+	if got := search(alice, MessageSearch{Query: "meet*"}); !reflect.DeepEqual(got, []string{"notes", "cafe"}) {
+		t.Errorf("alice searching meet* got %v, want [notes cafe]", got)
+	}
+	if got := search(bob, MessageSearch{Query: "meeting"}); !reflect.DeepEqual(got, []string{"secret", "hidden", "notes"}) {
+		t.Errorf("bob searching meeting got %v, want [secret hidden notes]", got)
+	}
+	if got := search(bob, MessageSearch{Query: "meeting", ConversationId: "group", SenderId: bob}); !reflect.DeepEqual(got, []string{"hidden", "notes"}) {
+		t.Errorf("bob searching the group messages bob sent got %v, want [hidden notes]", got)
+	}
+	if got := search(alice, MessageSearch{Query: `"meet at"`}); !reflect.DeepEqual(got, []string{"cafe"}) {
+		t.Errorf("alice searching a phrase got %v, want [cafe]", got)
+	}
+
+	page, hasMore, err := db.SearchMessages(ctx, bob, MessageSearch{Query: "meeting", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || !hasMore {
+		t.Fatalf("first page has %d results (more: %v), want 2 and more", len(page), hasMore)
+	}
+	page, hasMore, err = db.SearchMessages(ctx, bob, MessageSearch{Query: "meeting", Limit: 2, Before: page[1].MessageId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].MessageId != "notes" || hasMore {
+		t.Errorf("second page is %+v (more: %v), want only notes", page, hasMore)
+	}
+
+	if _, _, err := db.SearchMessages(ctx, alice, MessageSearch{Query: ` "" * `, Limit: 10}); !errors.Is(err, ErrInvalidSearchQuery) {
+		t.Errorf("searching without terms returned %v, want ErrInvalidSearchQuery", err)
+	}
+	if _, _, err := db.SearchMessages(ctx, alice, MessageSearch{Query: "meeting", Limit: 10, Before: "missing"}); !errors.Is(err, ErrMessageDoesNotExist) {
+		t.Errorf("searching before a missing message returned %v, want ErrMessageDoesNotExist", err)
+	}
+}
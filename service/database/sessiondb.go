@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (db *appdbimpl) CreateSession(ctx context.Context, token, userID string, expiresAt time.Time) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `
+		INSERT INTO sessions (token, userId, createdAt, expiresAt)
+		VALUES (?, ?, ?, ?)
+	`, token, userID, time.Now().Format(time.RFC3339), expiresAt.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	return nil
+}
+
+func (db *appdbimpl) GetSessionUser(ctx context.Context, token string) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var user User
+	var expiresAt string
+	err = db.c.QueryRowContext(ctx, `
+		SELECT u.id, u.name, IFNULL(u.photoId, ''), s.expiresAt
+		FROM sessions s
+		JOIN users u ON s.userId = u.id
+		WHERE s.token = ?
+	`, token).Scan(&user.Id, &user.Name, &user.PhotoId, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrSessionDoesNotExist
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("error fetching session: %w", err)
+	}
+	expiry, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return User{}, fmt.Errorf("error parsing session expiry: %w", err)
+	}
+	if !time.Now().Before(expiry) {
+		if err := db.DeleteSession(ctx, token); err != nil {
+			return User{}, err
+		}
+		return User{}, ErrSessionExpired
+	}
+	return user, nil
+}
+
+func (db *appdbimpl) DeleteSession(ctx context.Context, token string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `DELETE FROM sessions WHERE token = ?`, token)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+func (db *appdbimpl) DeleteExpiredSessions(ctx context.Context) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `DELETE FROM sessions WHERE expiresAt <= ?`, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("error deleting expired sessions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (db *appdbimpl) StarMessage(ctx context.Context, messageID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	res, err := db.c.ExecContext(ctx, `
+		INSERT INTO starred_messages (userId, messageId, conversationId, starredAt)
+		SELECT ?, id, conversationId, ? FROM messages WHERE id = ?
+		ON CONFLICT (userId, messageId) DO NOTHING
+	`, userID, time.Now().Format(time.RFC3339), messageID)
+	if err != nil {
+		return fmt.Errorf("error starring message: %w", err)
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		var exists bool
+		err := db.c.QueryRowContext(ctx, `
+			SELECT EXISTS(SELECT 1 FROM messages WHERE id = ?)
+		`, messageID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("error checking message existence: %w", err)
+		}
+		if !exists {
+			return ErrMessageDoesNotExist
+		}
+	}
+	return nil
+}
+
+func (db *appdbimpl) UnstarMessage(ctx context.Context, messageID, userID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, `
+		DELETE FROM starred_messages WHERE messageId = ? AND userId = ?
+	`, messageID, userID)
+	if err != nil {
+		return fmt.Errorf("error unstarring message: %w", err)
+	}
+	return nil
+}
+
+// GetStarredMessages returns the messages starred by the user in the
+// conversations they still belong to, most recently starred first.
+func (db *appdbimpl) GetStarredMessages(ctx context.Context, userID string) (_ []StarredMessage, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	rows, err := db.c.QueryContext(ctx, `
+SELECT `+messageColumns+`,
+    CASE
+        WHEN c.type = 'direct' THEN IFNULL(
+            (SELECT ou.name
+            FROM users ou
+            JOIN conversation_members cm2 ON ou.id = cm2.userId
+            WHERE cm2.conversationId = c.id AND ou.id != st.userId),
+            c.name)
+        ELSE c.name
+    END AS conversationName,
+    c.type,
+    st.starredAt
+FROM starred_messages st
+JOIN messages m ON m.id = st.messageId
+JOIN conversations c ON c.id = m.conversationId
+JOIN conversation_members cm ON cm.conversationId = c.id AND cm.userId = st.userId `+messageJoins+`
+WHERE st.userId = ? AND m.deletedAt IS NULL
+ORDER BY st.starredAt DESC, st.rowid DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching starred messages: %w", err)
+	}
+	defer rows.Close()
+	var starred []StarredMessage
+	for rows.Next() {
+		var sm StarredMessage
+		sm.Message, err = scanMessage(rows, &sm.ConversationName, &sm.ConversationType, &sm.StarredAt)
+		if err != nil {
+			return nil, err
+		}
+		starred = append(starred, sm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating starred messages: %w", err)
+	}
+	messages := make([]Message, len(starred))
+	for i := range starred {
+		messages[i] = starred[i].Message
+	}
+	if err := db.loadReactions(ctx, messages); err != nil {
+		return nil, err
+	}
+	for i := range starred {
+		starred[i].Reactions = messages[i].Reactions
+	}
+	return starred, nil
+}
+
+// clearStarredMessages removes the user's stars in a conversation they no
+// longer belong to.
+func clearStarredMessages(ctx context.Context, tx *sql.Tx, conversationID, userID string) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM starred_messages WHERE conversationId = ? AND userId = ?
+	`, conversationID, userID)
+	if err != nil {
+		return fmt.Errorf("error clearing starred messages: %w", err)
+	}
+	return nil
+}
@@ -1,15 +1,19 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 )
 
-func (db *appdbimpl) CreateUser(u User) (User, error) {
-	_, err := db.c.Exec("INSERT INTO users(id, name, photo) VALUES (?, ?, ?)", u.Id, u.Name, u.Photo)
+func (db *appdbimpl) CreateUser(ctx context.Context, u User) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	_, err = db.c.ExecContext(ctx, "INSERT INTO users(id, name, photoId) VALUES (?, ?, NULLIF(?, ''))", u.Id, u.Name, u.PhotoId)
 	if err != nil {
 		var existing User
-		if errCheck := db.c.QueryRow("SELECT id, name FROM users WHERE name = ?", u.Name).Scan(&existing.Id, &existing.Name); errCheck != nil {
+		if errCheck := db.c.QueryRowContext(ctx, "SELECT id, name FROM users WHERE name = ?", u.Name).Scan(&existing.Id, &existing.Name); errCheck != nil {
 			if errCheck == sql.ErrNoRows {
 				return u, err
 			}
@@ -19,9 +23,11 @@ func (db *appdbimpl) CreateUser(u User) (User, error) {
 	return u, nil
 }
 
-func (db *appdbimpl) GetUserByName(name string) (User, error) {
+func (db *appdbimpl) GetUserByName(ctx context.Context, name string) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var u User
-	if err := db.c.QueryRow("SELECT id, name FROM users WHERE name = ?", name).Scan(&u.Id, &u.Name); err != nil {
+	if err := db.c.QueryRowContext(ctx, "SELECT id, name FROM users WHERE name = ?", name).Scan(&u.Id, &u.Name); err != nil {
 		if err == sql.ErrNoRows {
 			return u, ErrUserDoesNotExist
 		}
@@ -30,9 +36,11 @@ func (db *appdbimpl) GetUserByName(name string) (User, error) {
 	return u, nil
 }
 
-func (db *appdbimpl) GetUserById(id string) (User, error) {
+func (db *appdbimpl) GetUserById(ctx context.Context, id string) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var u User
-	if err := db.c.QueryRow("SELECT id, name FROM users WHERE id = ?", id).Scan(&u.Id, &u.Name); err != nil {
+	if err := db.c.QueryRowContext(ctx, "SELECT id, name FROM users WHERE id = ?", id).Scan(&u.Id, &u.Name); err != nil {
 		if err == sql.ErrNoRows {
 			return u, ErrUserDoesNotExist
 		}
@@ -41,8 +49,10 @@ func (db *appdbimpl) GetUserById(id string) (User, error) {
 	return u, nil
 }
 
-func (db *appdbimpl) UpdateUserName(userId, newName string) (User, error) {
-	res, err := db.c.Exec(`UPDATE users SET name=? WHERE id=?`, newName, userId)
+func (db *appdbimpl) UpdateUserName(ctx context.Context, userId, newName string) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET name=? WHERE id=?`, newName, userId)
 	if err != nil {
 		return User{}, err
 	}
@@ -52,29 +62,36 @@ func (db *appdbimpl) UpdateUserName(userId, newName string) (User, error) {
 	} else if affected == 0 {
 		return User{}, ErrUserDoesNotExist
 	}
-	return db.GetUserById(userId)
+	return db.GetUserById(ctx, userId)
 }
 
-func (db *appdbimpl) UpdateUserPhoto(userID string, photo []byte) error {
-	var exists bool
-	err := db.c.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id=?)`, userID).Scan(&exists)
-	if err != nil {
+func (db *appdbimpl) UpdateUserPhoto(ctx context.Context, userID string, photoID string) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	var previousPhotoID string
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT IFNULL(photoId, '') FROM users WHERE id=?`, userID).Scan(&previousPhotoID)
+		if err == sql.ErrNoRows {
+			return ErrUserDoesNotExist
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE users SET photoId=? WHERE id=?`, photoID, userID)
 		return err
-	}
-	if !exists {
-		return ErrUserDoesNotExist
-	}
-	_, err = db.c.Exec(`UPDATE users SET photo=? WHERE id=?`, photo, userID)
+	})
 	if err != nil {
 		return err
 	}
-	return nil
+	return db.deleteMediaIfUnused(ctx, previousPhotoID)
 }
 
-func (db *appdbimpl) SearchUsersByName(username string) ([]User, error) {
+func (db *appdbimpl) SearchUsersByName(ctx context.Context, username string) (_ []User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var users []User
-	rows, err := db.c.Query(`
-        SELECT id, name, photo
+	rows, err := db.c.QueryContext(ctx, `
+        SELECT id, name, IFNULL(photoId, '')
         FROM users
         WHERE name LIKE ?`,
 		"%"+username+"%")
@@ -84,7 +101,7 @@ func (db *appdbimpl) SearchUsersByName(username string) ([]User, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.Id, &user.Name, &user.Photo)
+		err := rows.Scan(&user.Id, &user.Name, &user.PhotoId)
 		if err != nil {
 			return nil, err
 		}
@@ -96,13 +113,15 @@ func (db *appdbimpl) SearchUsersByName(username string) ([]User, error) {
 	return users, nil
 }
 
-func (db *appdbimpl) GetUsersPhoto(userID string) (User, error) {
+func (db *appdbimpl) GetUsersPhoto(ctx context.Context, userID string) (_ User, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
 	var user User
-	err := db.c.QueryRow(`
-		SELECT id, name, photo 
-		FROM users 
+	err = db.c.QueryRowContext(ctx, `
+		SELECT id, name, IFNULL(photoId, '')
+		FROM users
 		WHERE id = ?
-	`, userID).Scan(&user.Id, &user.Name, &user.Photo)
+	`, userID).Scan(&user.Id, &user.Name, &user.PhotoId)
 	if err == sql.ErrNoRows {
 		return User{}, ErrUserDoesNotExist
 	} else if err != nil {
@@ -110,3 +129,90 @@ func (db *appdbimpl) GetUsersPhoto(userID string) (User, error) {
 	}
 	return user, nil
 }
+
+func (db *appdbimpl) SetPresenceVisibility(ctx context.Context, userID string, visible bool) (err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	res, err := db.c.ExecContext(ctx, `UPDATE users SET presenceVisible=? WHERE id=?`, visible, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrUserDoesNotExist
+	}
+	return nil
+}
+
+func (db *appdbimpl) GetPresenceVisibility(ctx context.Context, userIDs []string) (_ map[string]bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	visibility := make(map[string]bool, len(userIDs))
+	if len(userIDs) == 0 {
+		return visibility, nil
+	}
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT id, presenceVisible
+		FROM users
+		WHERE id IN (?`+strings.Repeat(", ?", len(userIDs)-1)+`)`,
+		args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching presence visibility: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var visible bool
+		if err := rows.Scan(&id, &visible); err != nil {
+			return nil, fmt.Errorf("error scanning presence visibility: %w", err)
+		}
+		visibility[id] = visible
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating presence visibility: %w", err)
+	}
+	return visibility, nil
+}
+
+// GetConversationPartners returns which of the candidates share at least
+// one conversation with the user.
+func (db *appdbimpl) GetConversationPartners(ctx context.Context, userID string, candidateIDs []string) (_ map[string]bool, err error) {
+	ctx, done := db.operation(ctx, &err)
+	defer done()
+	partners := make(map[string]bool, len(candidateIDs))
+	if len(candidateIDs) == 0 {
+		return partners, nil
+	}
+	args := make([]interface{}, 0, len(candidateIDs)+1)
+	args = append(args, userID)
+	for _, id := range candidateIDs {
+		args = append(args, id)
+	}
+	rows, err := db.c.QueryContext(ctx, `
+		SELECT DISTINCT theirs.userId
+		FROM conversation_members mine
+		JOIN conversation_members theirs ON theirs.conversationId = mine.conversationId
+		WHERE mine.userId = ? AND theirs.userId IN (?`+strings.Repeat(", ?", len(candidateIDs)-1)+`)`,
+		args...)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching conversation partners: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning conversation partner: %w", err)
+		}
+		partners[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating conversation partners: %w", err)
+	}
+	return partners, nil
+}
@@ -0,0 +1,33 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetConversationPartners(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	users := createTestUsers(t, db, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := users[0], users[1], users[2], users[3]
+	if err := db.CreateDirectConversation(ctx, "direct", alice, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateGroupConversation(ctx, "group", bob, []string{carol}, "friends", ""); err != nil {
+		t.Fatal(err)
+	}
+	partners, err := db.GetConversationPartners(ctx, alice, []string{bob, carol, dave, "user-nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partners) != 1 || !partners[bob] {
+		t.Errorf("alice's partners are %v, want only bob", partners)
+	}
+	partners, err = db.GetConversationPartners(ctx, bob, []string{alice, carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partners) != 2 {
+		t.Errorf("bob's partners are %v, want alice and carol", partners)
+	}
+}
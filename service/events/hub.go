@@ -0,0 +1,166 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	MessageCreated  = "message.created"
+	MessageEdited   = "message.edited"
+	MessageDeleted  = "message.deleted"
+	MessageHidden   = "message.hidden"
+	MessagePinned   = "message.pinned"
+	MessageUnpinned = "message.unpinned"
+	ReactionAdded   = "reaction.added"
+	ReactionRemoved = "reaction.removed"
+	MessagesRead    = "messages.read"
+
+	MessagesDelivered = "messages.delivered"
+
+	ConversationCreated = "conversation.created"
+	GroupUpdated        = "group.updated"
+
+	Typing = "typing"
+)
+
+var ErrHubClosed = errors.New("Event hub is closed")
+
+type Event struct {
+	Id             uint64      `json:"id,omitempty"`
+	Type           string      `json:"type"`
+	ConversationId string      `json:"conversationId"`
+	Timestamp      string      `json:"timestamp"`
+	Payload        interface{} `json:"payload,omitempty"`
+	recipients     map[string]bool
+}
+
+// Subscription receives the events addressed to one user. C is closed when
+// the subscriber falls too far behind or the hub shuts down; clients are
+// expected to reconnect and resume from the last event id they saw.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	userID string
+}
+
+// Hub fans events out to subscribers and keeps a bounded backlog so that
+// reconnecting clients can catch up on what they missed.
+type Hub struct {
+	mu          sync.Mutex
+	nextID      uint64
+	backlog     []Event
+	backlogSize int
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+func NewHub(backlogSize int) *Hub {
+	return &Hub{
+		nextID:      1,
+		backlogSize: backlogSize,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Publish delivers an event to the given recipients (user ids).
+func (h *Hub) Publish(eventType, conversationID string, payload interface{}, recipients []string) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	event := newEvent(h.nextID, eventType, conversationID, payload, recipients)
+	h.nextID++
+	h.backlog = append(h.backlog, event)
+	if len(h.backlog) > h.backlogSize {
+		h.backlog = h.backlog[len(h.backlog)-h.backlogSize:]
+	}
+	h.deliver(event)
+	return event
+}
+
+// Notify delivers an ephemeral event, such as a typing indicator, to the
+// subscribers connected right now. It has no id and is never replayed.
+func (h *Hub) Notify(eventType, conversationID string, payload interface{}, recipients []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deliver(newEvent(0, eventType, conversationID, payload, recipients))
+}
+
+func newEvent(id uint64, eventType, conversationID string, payload interface{}, recipients []string) Event {
+	event := Event{
+		Id:             id,
+		Type:           eventType,
+		ConversationId: conversationID,
+		Timestamp:      time.Now().Format(time.RFC3339),
+		Payload:        payload,
+		recipients:     make(map[string]bool, len(recipients)),
+	}
+	for _, r := range recipients {
+		event.recipients[r] = true
+	}
+	return event
+}
+
+func (h *Hub) deliver(event Event) {
+	for sub := range h.subscribers {
+		if !event.recipients[sub.userID] {
+			continue
+		}
+		select {
+		case sub.c <- event:
+		default:
+			h.drop(sub)
+		}
+	}
+}
+
+// Subscribe registers a subscriber for userID. When lastEventID is not zero
+// the events the user missed since then are returned as well; complete is
+// false if some of them already fell out of the backlog.
+func (h *Hub) Subscribe(userID string, lastEventID uint64) (sub *Subscription, missed []Event, complete bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, nil, false, ErrHubClosed
+	}
+	complete = true
+	if lastEventID > 0 {
+		if lastEventID >= h.nextID {
+			// The id is from before a server restart.
+			complete = false
+		} else if len(h.backlog) > 0 && h.backlog[0].Id > lastEventID+1 {
+			complete = false
+		}
+		for _, event := range h.backlog {
+			if event.Id > lastEventID && event.recipients[userID] {
+				missed = append(missed, event)
+			}
+		}
+	}
+	c := make(chan Event, 64)
+	sub = &Subscription{C: c, c: c, userID: userID}
+	h.subscribers[sub] = struct{}{}
+	return sub, missed, complete, nil
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(sub)
+}
+
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.drop(sub)
+	}
+}
+
+func (h *Hub) drop(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.c)
+	}
+}
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func eventIDs(events []Event) []uint64 {
+	ids := make([]uint64, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.Id)
+	}
+	return ids
+}
+
+func equalIDs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestResume(t *testing.T) {
+	hub := NewHub(10)
+	defer hub.Close()
+	first := hub.Publish(MessageCreated, "conv", nil, []string{"alice", "bob"})
+	hub.Publish(MessageCreated, "other", nil, []string{"bob"})
+	third := hub.Publish(MessageEdited, "conv", nil, []string{"alice", "bob"})
+
+	sub, missed, complete, err := hub.Subscribe("alice", first.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete || !equalIDs(eventIDs(missed), []uint64{third.Id}) {
+		t.Errorf("resuming after %d missed %v (complete %v), want [%d] and complete", first.Id, eventIDs(missed), complete, third.Id)
+	}
+
+	hub.Publish(MessageCreated, "other", nil, []string{"bob"})
+	live := hub.Publish(MessageDeleted, "conv", nil, []string{"alice"})
+	hub.Notify(Typing, "conv", nil, []string{"alice"})
+	if event := <-sub.C; event.Id != live.Id {
+		t.Errorf("first live event is %d, want %d", event.Id, live.Id)
+	}
+	if event := <-sub.C; event.Type != Typing || event.Id != 0 {
+		t.Errorf("second live event is %+v, want a typing notification without id", event)
+	}
+	if _, missed, _, _ := hub.Subscribe("alice", live.Id); len(missed) != 0 {
+		t.Errorf("resuming from the latest event missed %v, want nothing", eventIDs(missed))
+	}
+}
+
+func TestResumeBeyondBacklog(t *testing.T) {
+	hub := NewHub(2)
+	defer hub.Close()
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, hub.Publish(MessageCreated, "conv", nil, []string{"alice"}).Id)
+	}
+
+	_, missed, complete, err := hub.Subscribe("alice", ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete || !equalIDs(eventIDs(missed), ids[3:]) {
+		t.Errorf("resuming from a dropped event missed %v (complete %v), want %v and incomplete", eventIDs(missed), complete, ids[3:])
+	}
+	if _, _, complete, _ := hub.Subscribe("alice", ids[2]); !complete {
+		t.Error("resuming from the event just before the backlog is incomplete")
+	}
+	// An id the hub has not handed out comes from before a restart.
+	if _, missed, complete, _ := hub.Subscribe("alice", ids[4]+10); complete || len(missed) != 0 {
+		t.Errorf("resuming from a future id missed %v (complete %v), want nothing and incomplete", eventIDs(missed), complete)
+	}
+}
+
+func TestDropBlockedSubscriber(t *testing.T) {
+	hub := NewHub(1000)
+	blocked, _, _, err := hub.Subscribe("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reading, _, _, err := hub.Subscribe("bob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < cap(blocked.c)+1; i++ {
+		hub.Publish(MessageCreated, "conv", nil, []string{"alice", "bob"})
+		<-reading.C
+	}
+	var buffered int
+	for range blocked.C {
+		buffered++
+	}
+	if buffered != cap(blocked.c) {
+		t.Errorf("blocked subscriber got %d events before being dropped, want %d", buffered, cap(blocked.c))
+	}
+	hub.Publish(MessageCreated, "conv", nil, []string{"bob"})
+	if _, ok := <-reading.C; !ok {
+		t.Error("the subscriber keeping up was dropped too")
+	}
+	hub.Unsubscribe(blocked)
+
+	hub.Close()
+	if _, ok := <-reading.C; ok {
+		t.Error("subscription still open after the hub closed")
+	}
+	if _, _, _, err := hub.Subscribe("alice", 0); !errors.Is(err, ErrHubClosed) {
+		t.Errorf("subscribing to a closed hub returned %v, want ErrHubClosed", err)
+	}
+}
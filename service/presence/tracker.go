@@ -0,0 +1,114 @@
+package presence
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tassdam/wasa/service/globaltime"
+)
+
+// Tracker keeps ephemeral, in-memory presence state: when each user was
+// last active, how many event streams they have open and who is typing in
+// which conversation. Nothing here survives a restart.
+type Tracker struct {
+	mu          sync.Mutex
+	onlineTTL   time.Duration
+	typingTTL   time.Duration
+	lastSeen    map[string]time.Time
+	connections map[string]int
+	typing      map[string]map[string]time.Time
+}
+
+func NewTracker(onlineTTL, typingTTL time.Duration) *Tracker {
+	return &Tracker{
+		onlineTTL:   onlineTTL,
+		typingTTL:   typingTTL,
+		lastSeen:    map[string]time.Time{},
+		connections: map[string]int{},
+		typing:      map[string]map[string]time.Time{},
+	}
+}
+
+// Touch records activity by the user.
+func (t *Tracker) Touch(userID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastSeen[userID] = globaltime.Now()
+}
+
+// Connect marks the user online for as long as the returned function has
+// not been called, e.g. while an event stream is open.
+func (t *Tracker) Connect(userID string) (disconnect func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connections[userID]++
+	t.lastSeen[userID] = globaltime.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connections[userID]--
+			if t.connections[userID] <= 0 {
+				delete(t.connections, userID)
+			}
+			t.lastSeen[userID] = globaltime.Now()
+		})
+	}
+}
+
+// Status reports whether the user is online and when they were last seen.
+// A zero lastSeen means the user has not been seen since the server started.
+func (t *Tracker) Status(userID string) (online bool, lastSeen time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lastSeen = t.lastSeen[userID]
+	online = t.connections[userID] > 0 || (!lastSeen.IsZero() && globaltime.Since(lastSeen) < t.onlineTTL)
+	return online, lastSeen
+}
+
+// SetTyping records that the user is (or stopped) typing in a conversation.
+// It reports whether the state changed, so callers only announce changes.
+func (t *Tracker) SetTyping(conversationID, userID string, typing bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := globaltime.Now()
+	users := t.typing[conversationID]
+	expiry, wasTyping := users[userID]
+	wasTyping = wasTyping && now.Before(expiry)
+	if typing {
+		if users == nil {
+			users = map[string]time.Time{}
+			t.typing[conversationID] = users
+		}
+		users[userID] = now.Add(t.typingTTL)
+	} else if users != nil {
+		delete(users, userID)
+		if len(users) == 0 {
+			delete(t.typing, conversationID)
+		}
+	}
+	return wasTyping != typing
+}
+
+// Typing returns the users currently typing in the conversation.
+func (t *Tracker) Typing(conversationID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := globaltime.Now()
+	users := t.typing[conversationID]
+	typing := []string{}
+	for userID, expiry := range users {
+		if now.Before(expiry) {
+			typing = append(typing, userID)
+		} else {
+			delete(users, userID)
+		}
+	}
+	if len(users) == 0 {
+		delete(t.typing, conversationID)
+	}
+	sort.Strings(typing)
+	return typing
+}
@@ -0,0 +1,82 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tassdam/wasa/service/globaltime"
+)
+
+// setClock fixes the time seen by the tracker for the rest of the test.
+func setClock(t *testing.T, now time.Time) {
+	globaltime.FixedTime = now
+	t.Cleanup(func() {
+		globaltime.FixedTime = time.Time{}
+	})
+}
+
+func TestStatus(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	tracker := NewTracker(time.Minute, 5*time.Second)
+
+	if online, lastSeen := tracker.Status("alice"); online || !lastSeen.IsZero() {
+		t.Errorf("unseen user is online %v, last seen %v; want offline and never seen", online, lastSeen)
+	}
+	tracker.Touch("alice")
+	setClock(t, start.Add(59*time.Second))
+	if online, lastSeen := tracker.Status("alice"); !online || !lastSeen.Equal(start) {
+		t.Errorf("user active 59s ago is online %v, last seen %v; want online since %v", online, lastSeen, start)
+	}
+	setClock(t, start.Add(time.Minute))
+	if online, lastSeen := tracker.Status("alice"); online || !lastSeen.Equal(start) {
+		t.Errorf("user active a minute ago is online %v, last seen %v; want offline since %v", online, lastSeen, start)
+	}
+
+	// An open connection keeps the user online however long it lasts, and
+	// closing it counts as activity.
+	disconnect := tracker.Connect("alice")
+	setClock(t, start.Add(time.Hour))
+	if online, _ := tracker.Status("alice"); !online {
+		t.Error("connected user is offline")
+	}
+	disconnect()
+	disconnect()
+	if online, lastSeen := tracker.Status("alice"); !online || !lastSeen.Equal(start.Add(time.Hour)) {
+		t.Errorf("just disconnected user is online %v, last seen %v; want online since the disconnect", online, lastSeen)
+	}
+	setClock(t, start.Add(time.Hour+time.Minute))
+	if online, _ := tracker.Status("alice"); online {
+		t.Error("user is online a minute after disconnecting")
+	}
+}
+
+func TestTyping(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	setClock(t, start)
+	tracker := NewTracker(time.Minute, 5*time.Second)
+
+	if !tracker.SetTyping("conv", "bob", true) || !tracker.SetTyping("conv", "alice", true) {
+		t.Fatal("starting to type did not change the state")
+	}
+	if tracker.SetTyping("conv", "alice", true) {
+		t.Error("typing again changed the state")
+	}
+	if typing := tracker.Typing("conv"); len(typing) != 2 || typing[0] != "alice" || typing[1] != "bob" {
+		t.Errorf("typing in conv: %v, want [alice bob]", typing)
+	}
+	if !tracker.SetTyping("conv", "bob", false) {
+		t.Error("stopping typing did not change the state")
+	}
+
+	setClock(t, start.Add(5*time.Second))
+	if typing := tracker.Typing("conv"); len(typing) != 0 {
+		t.Errorf("typing in conv after the indicator expired: %v, want nobody", typing)
+	}
+	if tracker.SetTyping("conv", "alice", false) {
+		t.Error("stopping after the indicator expired changed the state")
+	}
+	if !tracker.SetTyping("conv", "alice", true) {
+		t.Error("typing after the indicator expired did not change the state")
+	}
+}
@@ -2,6 +2,8 @@ import { createRouter, createWebHashHistory } from "vue-router";
 import LoginView from "../views/LoginView.vue";
 import HomeView from "../views/HomeView.vue";
 import SearchPeopleView from "../views/SearchPeopleView.vue";
+import SearchMessagesView from "../views/SearchMessagesView.vue";
+import StarredView from "../views/StarredView.vue";
 import ChatView from "../views/ChatView.vue";
 import ProfileView from "../views/ProfileView.vue";
 import GroupsView from "../views/GroupsView.vue"
@@ -12,6 +14,8 @@ const routes = [
   { path: "/", component: LoginView },
   { path: "/home", component: HomeView },
   { path: "/search", component: SearchPeopleView },
+  { path: "/search/messages", component: SearchMessagesView },
+  { path: "/starred", component: StarredView },
   { path: "/conversations/:uuid", name: "ChatView", component: ChatView, props: true },
   { path: "/me", component: ProfileView},
   { path: "/groups", component: GroupsView},
@@ -5,4 +5,12 @@ const instance = axios.create({
 	timeout: 1000 * 5
 });
 
+instance.interceptors.request.use((config) => {
+	const token = localStorage.getItem("token");
+	if (token && !config.headers.Authorization) {
+		config.headers.Authorization = `Bearer ${token}`;
+	}
+	return config;
+});
+
 export default instance;
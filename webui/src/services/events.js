@@ -0,0 +1,105 @@
+// Shared connection to the server's event stream (GET /events).
+// The server closes streams periodically; we reconnect with the id of the
+// last event seen so nothing is missed. A "resync" event means the server
+// could not replay everything and listeners should reload their state.
+
+const listeners = new Set();
+let lastEventId = null;
+let controller = null;
+let connecting = false;
+
+function dispatch(event) {
+	listeners.forEach((listener) => listener(event));
+}
+
+function parseBlock(block) {
+	const event = { id: null, type: "message", data: "" };
+	block.split("\n").forEach((line) => {
+		if (line.startsWith("id: ")) {
+			event.id = line.slice(4);
+		} else if (line.startsWith("event: ")) {
+			event.type = line.slice(7);
+		} else if (line.startsWith("data: ")) {
+			event.data += line.slice(6);
+		}
+	});
+	return event;
+}
+
+// connect runs a single reconnect loop for as long as there are listeners.
+// Each attempt keeps its own AbortController: unsubscribing clears the
+// shared one, and a listener may arrive again before the aborted attempt
+// has unwound.
+async function connect() {
+	if (connecting) {
+		return;
+	}
+	connecting = true;
+	try {
+		while (listeners.size > 0) {
+			const token = localStorage.getItem("token");
+			if (!token) {
+				return;
+			}
+			const current = new AbortController();
+			controller = current;
+			const headers = { Authorization: `Bearer ${token}` };
+			if (lastEventId) {
+				headers["Last-Event-ID"] = lastEventId;
+			}
+			try {
+				const response = await fetch(`${__API_URL__}/events`, { headers, signal: current.signal });
+				if (!response.ok) {
+					throw new Error(`event stream failed with status ${response.status}`);
+				}
+				const reader = response.body.getReader();
+				const decoder = new TextDecoder();
+				let buffer = "";
+				for (;;) {
+					const { value, done } = await reader.read();
+					if (done) {
+						break;
+					}
+					buffer += decoder.decode(value, { stream: true });
+					let index;
+					while ((index = buffer.indexOf("\n\n")) !== -1) {
+						const block = buffer.slice(0, index);
+						buffer = buffer.slice(index + 2);
+						const event = parseBlock(block);
+						if (!event.data) {
+							continue;
+						}
+						if (event.id) {
+							lastEventId = event.id;
+						}
+						dispatch({ type: event.type, ...JSON.parse(event.data) });
+					}
+				}
+			} catch (error) {
+				if (current.signal.aborted) {
+					// The last listener left; the loop condition decides
+					// whether a new one has subscribed since.
+					continue;
+				}
+				console.error("Event stream error:", error);
+				await new Promise((resolve) => setTimeout(resolve, 3000));
+			}
+		}
+	} finally {
+		connecting = false;
+	}
+}
+
+export function subscribe(listener) {
+	listeners.add(listener);
+	if (listeners.size === 1) {
+		connect();
+	}
+	return () => {
+		listeners.delete(listener);
+		if (listeners.size === 0 && controller) {
+			controller.abort();
+			controller = null;
+		}
+	};
+}
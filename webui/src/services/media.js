@@ -0,0 +1,27 @@
+import { reactive } from "vue";
+import axios from "./axios.js";
+
+const urls = reactive({});
+const pending = {};
+
+// Returns an object URL for the given media id, fetching it on first use.
+// The result is reactive, so templates re-render once the download finishes.
+export function mediaUrl(id) {
+	if (!id) {
+		return null;
+	}
+	if (!(id in urls) && !pending[id]) {
+		pending[id] = axios.get(`/media/${id}`, { responseType: "blob" })
+			.then((response) => {
+				urls[id] = URL.createObjectURL(response.data);
+			})
+			.catch((error) => {
+				console.error("Failed to load media:", error);
+				urls[id] = null;
+			})
+			.finally(() => {
+				delete pending[id];
+			});
+	}
+	return urls[id] || null;
+}